@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+
+	"github.com/hashicorp/terraform/terraform"
+	"github.com/kmott/terraform-provisioner-habitat/habitat"
+)
+
+const cliUsage = `Usage: terraform-provisioner-habitat apply --config <file> (--ssh-host <host> | --winrm-host <host>) [options]
+
+Runs the provisioner outside of Terraform.  The config file is a JSON object using the same arguments as the provisioner
+block, with blocks written as lists of objects (eg "service": [{"name": "core/redis"}]).
+
+Options:
+`
+
+// connectionFlags are the 'connection' block arguments the apply subcommand accepts, for SSH and WinRM targets
+type connectionFlags struct {
+	sshHost, sshUser, sshPassword, sshPrivateKey string
+	sshPort                                      int
+	sshAgent                                     bool
+
+	winrmHost, winrmUser, winrmPassword string
+	winrmPort                           int
+	winrmHTTPS, winrmInsecure           bool
+
+	timeout string
+}
+
+// connInfo returns the connection info the communicators expect, as Terraform would build it from a connection block
+func (f *connectionFlags) connInfo() (map[string]string, error) {
+	if (f.sshHost == "") == (f.winrmHost == "") {
+		return nil, errors.New("exactly one of --ssh-host or --winrm-host is required")
+	}
+
+	connInfo := map[string]string{}
+	if f.timeout != "" {
+		connInfo["timeout"] = f.timeout
+	}
+
+	if f.winrmHost != "" {
+		connInfo["type"] = "winrm"
+		connInfo["host"] = f.winrmHost
+		connInfo["user"] = f.winrmUser
+		connInfo["password"] = f.winrmPassword
+		connInfo["https"] = strconv.FormatBool(f.winrmHTTPS)
+		connInfo["insecure"] = strconv.FormatBool(f.winrmInsecure)
+		if f.winrmPort != 0 {
+			connInfo["port"] = strconv.Itoa(f.winrmPort)
+		}
+		return connInfo, nil
+	}
+
+	connInfo["type"] = "ssh"
+	connInfo["host"] = f.sshHost
+	connInfo["user"] = f.sshUser
+	connInfo["password"] = f.sshPassword
+	connInfo["agent"] = strconv.FormatBool(f.sshAgent)
+	if f.sshPort != 0 {
+		connInfo["port"] = strconv.Itoa(f.sshPort)
+	}
+	if f.sshPrivateKey != "" {
+		key, err := ioutil.ReadFile(f.sshPrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("error reading the SSH private key: %v", err)
+		}
+		connInfo["private_key"] = string(key)
+	}
+	return connInfo, nil
+}
+
+// cliOutput prints the provisioner's output, which Terraform would otherwise prefix and display
+type cliOutput struct {
+	w io.Writer
+}
+
+func (o *cliOutput) Output(line string) {
+	fmt.Fprintln(o.w, line)
+}
+
+// runCLI runs a subcommand, returning the process exit code
+func runCLI(args []string, stdout, stderr io.Writer) int {
+	if args[0] != "apply" {
+		fmt.Fprintf(stderr, "unknown command %q\n\n%s", args[0], cliUsage)
+		return 2
+	}
+
+	var configPath string
+	var conn connectionFlags
+
+	fs := flag.NewFlagSet("apply", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, cliUsage)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&configPath, "config", "", "JSON file holding the provisioner configuration")
+	fs.StringVar(&conn.sshHost, "ssh-host", "", "Address of an SSH target")
+	fs.StringVar(&conn.sshUser, "ssh-user", "root", "User to connect as over SSH")
+	fs.StringVar(&conn.sshPassword, "ssh-password", "", "Password to connect with over SSH")
+	fs.StringVar(&conn.sshPrivateKey, "ssh-private-key", "", "Path to the private key to connect with over SSH")
+	fs.IntVar(&conn.sshPort, "ssh-port", 0, "SSH port (default 22)")
+	fs.BoolVar(&conn.sshAgent, "ssh-agent", false, "Authenticate with the running SSH agent")
+	fs.StringVar(&conn.winrmHost, "winrm-host", "", "Address of a WinRM target")
+	fs.StringVar(&conn.winrmUser, "winrm-user", "Administrator", "User to connect as over WinRM")
+	fs.StringVar(&conn.winrmPassword, "winrm-password", "", "Password to connect with over WinRM")
+	fs.IntVar(&conn.winrmPort, "winrm-port", 0, "WinRM port (default 5985, or 5986 with --winrm-https)")
+	fs.BoolVar(&conn.winrmHTTPS, "winrm-https", false, "Connect to WinRM over HTTPS")
+	fs.BoolVar(&conn.winrmInsecure, "winrm-insecure", false, "Skip verifying the WinRM certificate")
+	fs.StringVar(&conn.timeout, "timeout", "", "How long to wait for the connection (default 5m)")
+
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if configPath == "" {
+		fmt.Fprintln(stderr, "--config is required")
+		return 2
+	}
+
+	connInfo, err := conn.connInfo()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	// The communicators log every connection attempt, which Terraform only shows with TF_LOG
+	if os.Getenv("TF_LOG") == "" {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	content, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		fmt.Fprintf(stderr, "error reading the config: %v\n", err)
+		return 1
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal(content, &raw); err != nil {
+		fmt.Fprintf(stderr, "error decoding %s: %v\n", configPath, err)
+		return 1
+	}
+
+	if err := apply(&cliOutput{w: stdout}, raw, connInfo); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// apply validates and runs the provisioner the way Terraform does, stopping it on an interrupt
+func apply(o terraform.UIOutput, raw map[string]interface{}, connInfo map[string]string) error {
+	p := habitat.Provision()
+	c := terraform.NewResourceConfigRaw(raw)
+
+	ws, es := p.Validate(c)
+	for _, w := range ws {
+		o.Output("Warning: " + w)
+	}
+	if len(es) > 0 {
+		msg := "invalid configuration:"
+		for _, e := range es {
+			msg += "\n  " + e.Error()
+		}
+		return errors.New(msg)
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(interrupt, os.Interrupt)
+	defer func() {
+		signal.Stop(interrupt)
+		close(done)
+	}()
+	go func() {
+		select {
+		case <-interrupt:
+			o.Output("Interrupted, stopping...")
+			_ = p.Stop()
+		case <-done:
+		}
+	}()
+
+	s := &terraform.InstanceState{
+		Ephemeral: terraform.EphemeralState{ConnInfo: connInfo},
+	}
+	return p.Apply(o, s, c)
+}
@@ -6,7 +6,7 @@ require (
 	cloud.google.com/go v0.61.0 // indirect
 	github.com/google/go-cmp v0.5.2 // indirect
 	github.com/hashicorp/go-getter v1.5.0 // indirect
-	github.com/hashicorp/go-version v1.2.1 // indirect
+	github.com/hashicorp/go-version v1.2.1
 	github.com/hashicorp/terraform v0.13.5
 	github.com/kr/text v0.2.0 // indirect
 	github.com/mitchellh/go-linereader v0.0.0-20190213213312-1b945b3263eb
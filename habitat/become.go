@@ -0,0 +1,124 @@
+package habitat
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/hashicorp/terraform/configs/hcl2shim"
+)
+
+// Become describes how Linux commands are escalated to root
+type Become struct {
+	// Method is one of 'sudo', 'doas', 'su' or 'none'
+	Method string
+
+	// Password is written to the escalation tool's stdin, and only supported by 'sudo'
+	Password string
+
+	// PreserveEnv lists variables carried over from the connecting user's environment
+	PreserveEnv []string
+}
+
+// getBecome decodes the 'become' block, falling back to 'use_sudo' when the block is omitted
+func getBecome(v []interface{}, useSudo bool) Become {
+	b := Become{Method: "none"}
+	if useSudo {
+		b.Method = "sudo"
+	}
+
+	for _, rawBecomeData := range v {
+		becomeData, ok := rawBecomeData.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		b.Method = becomeData["method"].(string)
+		b.Password = becomeData["password"].(string)
+		b.PreserveEnv = getPeers(becomeData["preserve_env"].([]interface{}))
+	}
+
+	return b
+}
+
+// validateBecome checks the raw 'become' block for combinations the escalation tools cannot honour
+func validateBecome(v interface{}) (es []error) {
+	var blocks []map[string]interface{}
+	switch raw := v.(type) {
+	case []map[string]interface{}:
+		blocks = raw
+	case []interface{}:
+		for _, r := range raw {
+			if block, ok := r.(map[string]interface{}); ok {
+				blocks = append(blocks, block)
+			}
+		}
+	}
+
+	for _, block := range blocks {
+		method, _ := block["method"].(string)
+		if method == "" || method == hcl2shim.UnknownVariableValue {
+			method = "sudo"
+		}
+
+		if method != "sudo" && isSetConfigValue(block["password"]) {
+			es = append(es, fmt.Errorf("become: password is only supported by the sudo method, not %s", method))
+		}
+		if method == "su" && isSetConfigValue(block["preserve_env"]) {
+			es = append(es, fmt.Errorf("become: preserve_env is not supported by the su method"))
+		}
+	}
+
+	return es
+}
+
+// escalates reports whether commands and uploads need to go through the become method
+func (b *Become) escalates() bool {
+	return b.Method != "none"
+}
+
+// stdin returns the input to attach to every command, which feeds the password to 'sudo -S'
+func (b *Become) stdin() io.Reader {
+	if b.Method != "sudo" || b.Password == "" {
+		return nil
+	}
+	return strings.NewReader(b.Password + "\n")
+}
+
+// wrap runs a shell invocation with the given environment (a list of 'KEY=value' entries) as root
+func (b *Become) wrap(env []string, shell string) string {
+	switch b.Method {
+	case "sudo":
+		flags := " -E"
+		if len(b.PreserveEnv) > 0 {
+			flags = " --preserve-env=" + strings.Join(append(envNames(env), b.PreserveEnv...), ",")
+		}
+		if b.Password != "" {
+			flags = " -S -p ''" + flags
+		}
+		return fmt.Sprintf("env %s sudo%s %s", strings.Join(env, " "), flags, shell)
+	case "doas":
+		// doas rebuilds the environment, so it is passed explicitly, copying allow-listed values from the caller
+		for _, name := range b.PreserveEnv {
+			env = append(env, fmt.Sprintf(`%s="$%s"`, name, name))
+		}
+		return fmt.Sprintf("doas env %s %s", strings.Join(env, " "), shell)
+	case "su":
+		return fmt.Sprintf("su root -c %s", shellQuote(fmt.Sprintf("env %s %s", strings.Join(env, " "), shell)))
+	default:
+		return fmt.Sprintf("env %s %s", strings.Join(env, " "), shell)
+	}
+}
+
+// envNames returns the variable names of a list of 'KEY=value' entries
+func envNames(env []string) []string {
+	names := make([]string, 0, len(env))
+	for _, e := range env {
+		names = append(names, strings.SplitN(e, "=", 2)[0])
+	}
+	return names
+}
+
+// shellQuote single quotes a string for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,56 @@
+package habitat
+
+import (
+	"fmt"
+	"strings"
+
+	version "github.com/hashicorp/go-version"
+)
+
+// capability is a setting which only exists on some Habitat releases
+type capability struct {
+	// Setting is the provisioner argument which enables the capability
+	Setting string
+
+	// MinVersion is the first Habitat release accepting the resulting flag or environment variable
+	MinVersion string
+}
+
+// capabilities lists every version dependent setting the provisioner emits, in schema order
+var capabilities = []capability{
+	{Setting: "license", MinVersion: "0.81.0"},
+	{Setting: "http_disable", MinVersion: "0.56.0"},
+	{Setting: "event_stream", MinVersion: "0.83.0"},
+	{Setting: "keep_latest_packages", MinVersion: "1.6.0"},
+	{Setting: "update_condition", MinVersion: "1.6.0"},
+	{Setting: "service_min_backoff_period", MinVersion: "1.6.0"},
+	{Setting: "service_max_backoff_period", MinVersion: "1.6.0"},
+	{Setting: "service_restart_cooldown_period", MinVersion: "1.6.0"},
+}
+
+// parseVersion parses a Habitat release, ignoring any release timestamp (eg '1.6.181/20201030172917')
+func parseVersion(v string) (*version.Version, error) {
+	return version.NewVersion(strings.SplitN(v, "/", 2)[0])
+}
+
+// checkCapabilities returns an error for every setting in use which the given Habitat release does not support.
+// The isSet func reports whether a setting has been given a non-default value.
+func checkCapabilities(habVersion string, isSet func(setting string) bool) []error {
+	current, err := parseVersion(habVersion)
+	if err != nil {
+		return []error{fmt.Errorf("invalid Habitat version %q: %v", habVersion, err)}
+	}
+
+	var errs []error
+	for _, c := range capabilities {
+		if !isSet(c.Setting) {
+			continue
+		}
+
+		if current.LessThan(version.Must(parseVersion(c.MinVersion))) {
+			errs = append(errs, fmt.Errorf("%s requires Habitat %s or newer, but version %s is used", c.Setting, c.MinVersion, habVersion))
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,46 @@
+package habitat
+
+import (
+	"testing"
+)
+
+func TestCheckCapabilities(t *testing.T) {
+	cases := map[string]struct {
+		Version  string
+		Settings map[string]bool
+		Errors   int
+	}{
+		"No gated settings": {
+			Version:  "0.32.0",
+			Settings: map[string]bool{},
+		},
+		"Supported settings": {
+			Version:  "1.6.181/20201030172917",
+			Settings: map[string]bool{"license": true, "event_stream": true, "keep_latest_packages": true},
+		},
+		"License on an old release": {
+			Version:  "0.79.1",
+			Settings: map[string]bool{"license": true},
+			Errors:   1,
+		},
+		"Several unsupported settings": {
+			Version:  "1.5.0",
+			Settings: map[string]bool{"event_stream": true, "update_condition": true, "service_min_backoff_period": true},
+			Errors:   2,
+		},
+		"Invalid version": {
+			Version:  "not-a-version",
+			Settings: map[string]bool{},
+			Errors:   1,
+		},
+	}
+
+	for k, tc := range cases {
+		errs := checkCapabilities(tc.Version, func(setting string) bool {
+			return tc.Settings[setting]
+		})
+		if len(errs) != tc.Errors {
+			t.Fatalf("Test %q: expected %d errors, got %v", k, tc.Errors, errs)
+		}
+	}
+}
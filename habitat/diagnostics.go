@@ -0,0 +1,68 @@
+package habitat
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform/communicator"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+// diagnostic is one section of the support bundle, gathered by running Command on the target
+type diagnostic struct {
+	Name    string
+	Command string
+}
+
+// collectDiagnostics gathers the platform's diagnostics into a support bundle, and either saves it under
+// 'diagnostics_dir' or prints it.  Problems gathering the bundle are reported, but never replace the original error.
+func (p *provisioner) collectDiagnostics(o terraform.UIOutput, comm communicator.Communicator, platform Platform, cause error) {
+	o.Output("Collecting diagnostics...")
+	bundle := p.diagnosticsBundle(o, comm, platform, cause)
+
+	if p.DiagnosticsDir == "" {
+		o.Output(bundle)
+		return
+	}
+
+	path, err := writeDiagnostics(p.DiagnosticsDir, bundle, time.Now())
+	if err != nil {
+		o.Output(fmt.Sprintf("Failed to save the diagnostics bundle: %v", err))
+		o.Output(bundle)
+		return
+	}
+	o.Output("Saved the diagnostics bundle to " + path)
+}
+
+// diagnosticsBundle runs each diagnostic in turn, recording the error in place of a section's output when it fails
+func (p *provisioner) diagnosticsBundle(o terraform.UIOutput, comm communicator.Communicator, platform Platform, cause error) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Habitat diagnostics (%s)\n\nProvisioning failed: %v\n", platform.Name(), cause)
+
+	for _, d := range platform.Diagnostics() {
+		output, err := p.runCommandOutput(o, comm, d.Command)
+		if err != nil {
+			output = fmt.Sprintf("(failed: %v)", err)
+		}
+		fmt.Fprintf(&b, "\n## %s\n\n%s\n", d.Name, strings.TrimRight(output, "\r\n"))
+	}
+
+	return p.redact(b.String())
+}
+
+// writeDiagnostics saves the bundle to a timestamped file in dir, readable only by the current user
+func writeDiagnostics(dir, bundle string, now time.Time) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("habitat-diagnostics-%s.txt", now.UTC().Format("20060102T150405Z")))
+	if err := ioutil.WriteFile(path, []byte(bundle), 0600); err != nil {
+		return "", err
+	}
+	return path, nil
+}
@@ -0,0 +1,130 @@
+package habitat
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform/communicator"
+	"github.com/hashicorp/terraform/communicator/remote"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+func TestProvisioner_collectDiagnostics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "habitat-diagnostics")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := map[string]struct {
+		Dir string
+	}{
+		"Printed":  {},
+		"Saved":    {Dir: filepath.Join(dir, "bundles")},
+		"Disabled": {},
+	}
+
+	for k, tc := range cases {
+		cfg := map[string]interface{}{
+			"license":                "accept",
+			"builder_auth_token":     "dead-beef",
+			"diagnostics_on_failure": k != "Disabled",
+			"diagnostics_dir":        tc.Dir,
+		}
+		p, err := decodeConfig(
+			schema.TestResourceDataRaw(t, Provision().(*schema.Provisioner).Schema, cfg),
+		)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+
+		c := new(communicator.MockCommunicator)
+		c.CommandFunc = func(cmd *remote.Cmd) error {
+			switch cmd.Command {
+			case "hab svc status":
+				_, _ = cmd.Stdout.Write([]byte("No services loaded.\nHAB_AUTH_TOKEN=dead-beef\n"))
+				cmd.SetExitStatus(0, nil)
+			default:
+				cmd.SetExitStatus(1, nil)
+			}
+			return nil
+		}
+
+		// The old release fails the license capability check once hab is installed
+		o := &recordingOutput{}
+		err = p.apply(o, c, &fakePlatform{version: "0.79.1/20190410220617"})
+		if err == nil {
+			t.Fatalf("Test %q: expected provisioning to fail", k)
+		}
+
+		var bundle string
+		switch k {
+		case "Disabled":
+			if o.contains("Collecting diagnostics...") {
+				t.Fatalf("Test %q: diagnostics were collected without diagnostics_on_failure", k)
+			}
+			continue
+		case "Printed":
+			for _, line := range o.lines {
+				if strings.HasPrefix(line, "# Habitat diagnostics") {
+					bundle = line
+				}
+			}
+		case "Saved":
+			files, err := filepath.Glob(filepath.Join(tc.Dir, "habitat-diagnostics-*.txt"))
+			if err != nil || len(files) != 1 {
+				t.Fatalf("Test %q: expected one saved bundle, got %v (%v)", k, files, err)
+			}
+			content, err := ioutil.ReadFile(files[0])
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			bundle = string(content)
+		}
+
+		for _, want := range []string{"license requires Habitat 0.81.0 or newer", "## hab svc status\n\nNo services loaded.", "## supervisor log\n\n(failed: "} {
+			if !strings.Contains(bundle, want) {
+				t.Fatalf("Test %q: expected the bundle to contain %q, got %q", k, want, bundle)
+			}
+		}
+		if strings.Contains(bundle, "dead-beef") {
+			t.Fatalf("Test %q: the bundle leaks the builder auth token: %q", k, bundle)
+		}
+	}
+}
+
+func TestProvisioner_diagnostics_census(t *testing.T) {
+	p, err := decodeConfig(
+		schema.TestResourceDataRaw(t, Provision().(*schema.Provisioner).Schema, map[string]interface{}{
+			"use_sudo":           false,
+			"gateway_auth_token": "ea7-beef",
+		}),
+	)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	expected := map[string]string{
+		"linux":   `curl -s -H "Authorization: Bearer ea7-beef" http://127.0.0.1:9631/census`,
+		"windows": `Invoke-WebRequest -UseBasicParsing -Headers @{Authorization='Bearer ea7-beef'} -Uri http://127.0.0.1:9631/census`,
+	}
+	diagnostics := map[string][]diagnostic{
+		"linux":   p.linuxDiagnostics(),
+		"windows": p.windowsDiagnostics(),
+	}
+
+	for name, want := range expected {
+		found := false
+		for _, d := range diagnostics[name] {
+			if d.Name == "census" && strings.Contains(d.Command, want) {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("expected the %s census diagnostic to contain %q, got %v", name, want, diagnostics[name])
+		}
+	}
+}
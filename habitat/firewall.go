@@ -0,0 +1,71 @@
+package habitat
+
+import (
+	"net"
+	"strconv"
+)
+
+// firewallPort is a port the supervisor listens on which other hosts need to reach
+type firewallPort struct {
+	// Name identifies the listener and protocol (eg 'gossip-udp'), and is used to derive stable rule names
+	Name     string
+	Protocol string
+	Port     int
+}
+
+// firewallPortNames lists every name firewallPorts can return, so rules for listeners no longer exposed can be removed
+var firewallPortNames = []string{"gossip-tcp", "gossip-udp", "http-tcp", "ctl-tcp"}
+
+// firewallPorts returns the ports to open for the effective listener configuration.  Listeners bound to a loopback
+// address, and the HTTP gateway when it is disabled, are only reachable locally and are skipped.
+func (p *provisioner) firewallPorts() []firewallPort {
+	var ports []firewallPort
+
+	if !p.LocalGossipMode {
+		if port, ok := exposedPort(p.ListenGossip, "0.0.0.0:9638"); ok {
+			ports = append(ports,
+				firewallPort{Name: "gossip-tcp", Protocol: "tcp", Port: port},
+				firewallPort{Name: "gossip-udp", Protocol: "udp", Port: port},
+			)
+		}
+	}
+
+	if !p.HttpDisable {
+		if port, ok := exposedPort(p.ListenHTTP, "0.0.0.0:9631"); ok {
+			ports = append(ports, firewallPort{Name: "http-tcp", Protocol: "tcp", Port: port})
+		}
+	}
+
+	if port, ok := exposedPort(p.ListenCtl, "127.0.0.1:9632"); ok {
+		ports = append(ports, firewallPort{Name: "ctl-tcp", Protocol: "tcp", Port: port})
+	}
+
+	return ports
+}
+
+// exposedPort returns the port of a listen address (or the supervisor's default when unset), and whether the
+// listener is reachable from other hosts
+func exposedPort(address, defaultAddress string) (int, bool) {
+	if address == "" {
+		address = defaultAddress
+	}
+
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return 0, false
+	}
+
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return 0, false
+	}
+
+	if host == "localhost" {
+		return port, false
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return port, false
+	}
+
+	return port, true
+}
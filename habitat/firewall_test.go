@@ -0,0 +1,67 @@
+package habitat
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+func TestProvisioner_firewallPorts(t *testing.T) {
+	cases := map[string]struct {
+		Config map[string]interface{}
+		Ports  []firewallPort
+	}{
+		"Defaults": {
+			Config: map[string]interface{}{},
+			Ports: []firewallPort{
+				{Name: "gossip-tcp", Protocol: "tcp", Port: 9638},
+				{Name: "gossip-udp", Protocol: "udp", Port: 9638},
+				{Name: "http-tcp", Protocol: "tcp", Port: 9631},
+			},
+		},
+		"Custom listeners": {
+			Config: map[string]interface{}{
+				"listen_gossip": "0.0.0.0:19638",
+				"listen_http":   "10.0.0.5:19631",
+				"listen_ctl":    "0.0.0.0:19632",
+			},
+			Ports: []firewallPort{
+				{Name: "gossip-tcp", Protocol: "tcp", Port: 19638},
+				{Name: "gossip-udp", Protocol: "udp", Port: 19638},
+				{Name: "http-tcp", Protocol: "tcp", Port: 19631},
+				{Name: "ctl-tcp", Protocol: "tcp", Port: 19632},
+			},
+		},
+		"Local only listeners": {
+			Config: map[string]interface{}{
+				"local_gossip_mode": true,
+				"http_disable":      true,
+				"listen_ctl":        "localhost:9632",
+			},
+		},
+		"Loopback HTTP listener": {
+			Config: map[string]interface{}{
+				"listen_http": "127.0.0.1:9631",
+			},
+			Ports: []firewallPort{
+				{Name: "gossip-tcp", Protocol: "tcp", Port: 9638},
+				{Name: "gossip-udp", Protocol: "udp", Port: 9638},
+			},
+		},
+	}
+
+	for k, tc := range cases {
+		p, err := decodeConfig(
+			schema.TestResourceDataRaw(t, Provision().(*schema.Provisioner).Schema, tc.Config),
+		)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+
+		ports := p.firewallPorts()
+		if !reflect.DeepEqual(ports, tc.Ports) {
+			t.Fatalf("Test %q: expected ports %v, got %v", k, tc.Ports, ports)
+		}
+	}
+}
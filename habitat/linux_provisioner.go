@@ -16,73 +16,196 @@ import (
 )
 
 const installURL = "https://raw.githubusercontent.com/habitat-sh/habitat/master/components/hab/install.sh"
+const linuxCABundleDir = "/hab/cache/ssl"
+
+// linuxCurlCABundle is the system trust store with the custom CA bundle appended, which curl is pointed at so it
+// keeps trusting the public CAs as well
+const linuxCurlCABundle = "/hab/cache/terraform-provisioner-curl-ca.pem"
+
+// linuxSystemCABundles are the system trust stores of the common distributions, in the order they are looked for
+const linuxSystemCABundles = "/etc/ssl/certs/ca-certificates.crt /etc/pki/tls/certs/ca-bundle.crt /etc/ssl/ca-bundle.pem /etc/ssl/cert.pem"
+
+// Files of the unmanaged supervisor
+const linuxSupRunScript = "/hab/sup/default/sup-run.sh"
+const linuxSupPidFile = "/hab/sup/default/sup.pid"
+const linuxSupLogFile = "/hab/sup/default/sup.log"
 const systemdUnit = `[Unit]
 Description=Habitat Supervisor
-
+{{ range .Systemd.Unit }}{{ .Name }}={{ .Value }}
+{{ end }}
 [Service]
 ExecStart=/bin/hab sup run{{ .SupOptions }}
 Restart=on-failure
-{{ if .GatewayAuthToken -}}
-Environment="HAB_SUP_GATEWAY_AUTH_TOKEN={{ .GatewayAuthToken }}"
+{{ range .SupervisorEnvironment -}}
+Environment="{{ .Name }}={{ .Value }}"
 {{ end -}}
-{{ if .BuilderAuthToken -}}
-Environment="HAB_AUTH_TOKEN={{ .BuilderAuthToken }}"
+{{ range .Systemd.Environment -}}
+Environment="{{ .Name }}={{ .Value }}"
 {{ end -}}
-{{ if .License -}}
-Environment="HAB_LICENSE={{ .License }}"
+{{ range .Systemd.Service -}}
+{{ .Name }}={{ .Value }}
 {{ end -}}
 
 [Install]
 WantedBy=default.target
 `
 
-const startHabitatScript = `#!/bin/bash
+const startHabitatScript = `#!/bin/sh
 #
-# This starts or re-starts Habitat to the running system.  Uploaded to /tmp/re-start-habitat.sh, and called by various 
+# This starts or re-starts Habitat to the running system.  Uploaded to the staging directory, and called by various 
 # steps of the Linux Provisioner to configure the system.
 #
 __SERVICE_NAME="${1:-hab-supervisor.service}"
 __UNIT_FILE="${2:-/etc/systemd/system/${__SERVICE_NAME}}"
 __TMP_UNIT_FILE="${3:-/tmp/${__SERVICE_NAME}}"
 __NEW_CHECKSUM="${4}"
+__DROP_IN_FILE="${5:-${__UNIT_FILE}.d/terraform-provisioner.conf}"
+__TMP_DROP_IN_FILE="${6}"
 __EXISTING_CHECKSUM=
 
-if [[ -e "${__UNIT_FILE}" ]]; then
-	__EXISTING_CHECKSUM="$( cat "${__UNIT_FILE}" | sha256sum - | awk -F ' ' '{print $1}' )"
+# The checksum covers the unit followed by its drop-in, if there is one
+if [ -e "${__UNIT_FILE}" ]; then
+	__EXISTING_CHECKSUM="$( cat "${__UNIT_FILE}" "${__DROP_IN_FILE}" 2>/dev/null | sha256sum - | awk -F ' ' '{print $1}' )"
 fi
 
-if [[ "${__EXISTING_CHECKSUM}" != "${__NEW_CHECKSUM}" ]]; then
+if [ "${__EXISTING_CHECKSUM}" != "${__NEW_CHECKSUM}" ]; then
 	mv "${__TMP_UNIT_FILE}" "${__UNIT_FILE}"
+	if [ -n "${__TMP_DROP_IN_FILE}" ]; then
+		mkdir -p "$( dirname "${__DROP_IN_FILE}" )"
+		mv "${__TMP_DROP_IN_FILE}" "${__DROP_IN_FILE}"
+	else
+		rm -f "${__DROP_IN_FILE}"
+	fi
 	systemctl daemon-reload
 	systemctl restart "${__SERVICE_NAME}"
+fi
+
+systemctl enable "${__SERVICE_NAME}"
+`
+
+// startHabitatUnmanagedScript (re)starts a supervisor outside of an init system.  It only restarts a running
+// supervisor when the checksum of its run script changed.
+const startHabitatUnmanagedScript = `#!/bin/sh
+#
+# This starts or re-starts an unmanaged Habitat supervisor.  Uploaded to the staging directory, and called with the
+# supervisor's run script, the newly generated run script and its checksum, the pidfile and the log file.
+#
+__RUN_SCRIPT="${1:-/hab/sup/default/sup-run.sh}"
+__TMP_RUN_SCRIPT="${2}"
+__NEW_CHECKSUM="${3}"
+__PID_FILE="${4:-/hab/sup/default/sup.pid}"
+__LOG_FILE="${5:-/hab/sup/default/sup.log}"
+__LOG_SIZE=10485760
+__LOG_GENERATIONS=5
+__EXISTING_CHECKSUM=
+__PID=
+
+if [ -e "${__RUN_SCRIPT}" ]; then
+	__EXISTING_CHECKSUM="$( sha256sum "${__RUN_SCRIPT}" | awk -F ' ' '{print $1}' )"
+fi
 
-	# Wait for hab-supervisor to come back up
-	__RUNNING="$( hab svc status 2>/dev/null )"
-	while [[ -z "${__RUNNING}" ]]; do
-		echo "Waiting for Habitat to restart ..."
-		sleep 5
-		__RUNNING="$( hab svc status 2>/dev/null )"
+if [ -f "${__PID_FILE}" ]; then
+	__PID="$( cat "${__PID_FILE}" )"
+	if ! kill -0 "${__PID}" 2>/dev/null; then
+		__PID=
+	fi
+fi
+
+# A supervisor started without the pidfile (eg with setsid by earlier releases) is found by its launcher's process name,
+# so it is restarted rather than left holding the ports
+if [ -z "${__PID}" ] && command -v pgrep >/dev/null 2>&1; then
+	__PID="$( pgrep -o -x hab-launch || pgrep -o -x hab-sup )"
+fi
+
+if [ -n "${__PID}" ] && [ "${__EXISTING_CHECKSUM}" = "${__NEW_CHECKSUM}" ]; then
+	echo "Habitat is already running (pid ${__PID})"
+	echo "${__PID}" > "${__PID_FILE}"
+	rm -f "${__TMP_RUN_SCRIPT}"
+	exit 0
+fi
+
+mv "${__TMP_RUN_SCRIPT}" "${__RUN_SCRIPT}"
+chmod 0700 "${__RUN_SCRIPT}"
+
+if [ -n "${__PID}" ]; then
+	echo "Stopping Habitat (pid ${__PID}) ..."
+	kill "${__PID}"
+
+	# Give it 30 seconds to shut down its services, then force it
+	__WAITED=0
+	while kill -0 "${__PID}" 2>/dev/null; do
+		if [ "${__WAITED}" -ge 30 ]; then
+			echo "Habitat (pid ${__PID}) did not stop, killing it ..."
+			kill -9 "${__PID}" 2>/dev/null
+			sleep 1
+			break
+		fi
+		__WAITED=$(( __WAITED + 1 ))
+		sleep 1
 	done
 fi
 
-systemctl enable "${__SERVICE_NAME}"
+# Rotate the log on restart, keeping a few generations
+if [ -f "${__LOG_FILE}" ] && [ "$( wc -c < "${__LOG_FILE}" )" -gt "${__LOG_SIZE}" ]; then
+	__GENERATION="${__LOG_GENERATIONS}"
+	while [ "${__GENERATION}" -gt 1 ]; do
+		__PREVIOUS=$(( __GENERATION - 1 ))
+		if [ -f "${__LOG_FILE}.${__PREVIOUS}" ]; then
+			mv "${__LOG_FILE}.${__PREVIOUS}" "${__LOG_FILE}.${__GENERATION}"
+		fi
+		__GENERATION="${__PREVIOUS}"
+	done
+	mv "${__LOG_FILE}" "${__LOG_FILE}.1"
+fi
+
+# Where logrotate is available, also rotate the log while the supervisor runs
+if [ -d /etc/logrotate.d ]; then
+	cat > /etc/logrotate.d/hab-supervisor <<EOF
+${__LOG_FILE} {
+	size ${__LOG_SIZE}
+	rotate ${__LOG_GENERATIONS}
+	copytruncate
+	missingok
+	notifempty
+}
+EOF
+fi
+
+setsid "${__RUN_SCRIPT}" >> "${__LOG_FILE}" 2>&1 < /dev/null &
+echo $! > "${__PID_FILE}"
+`
+
+// unmanagedRunScript runs the supervisor with its environment and options, so a change to either alters its checksum
+const unmanagedRunScript = `#!/bin/sh
+exec env%s hab sup run%s
 `
 
 func (p *provisioner) linuxInstallHabitat(o terraform.UIOutput, comm communicator.Communicator) error {
+	// Skip the installer when the requested version is already in place, but still make sure the hab user exists
+	installed := p.linuxHabitatVersion(o, comm)
+	if versionMatches(installed, p.Version) {
+		o.Output(fmt.Sprintf("Habitat %s is already installed", installed))
+		return p.createHabUser(o, comm)
+	}
+
+	if installed != "" {
+		o.Output(fmt.Sprintf("Upgrading Habitat %s to %s...", installed, p.Version))
+	}
+
 	// Download the hab installer
-	if err := p.runCommand(o, comm, p.linuxGetCommand(fmt.Sprintf("curl --silent -L0 %s > install.sh", installURL))); err != nil {
+	if err := p.runNetworkCommand(o, comm, p.linuxGetCommand(fmt.Sprintf("curl --silent --show-error --fail -L0 %s > install.sh", installURL))); err != nil {
 		return err
 	}
 
 	// Run the install script
 	var command string
 	if p.Version == "" {
-		command = "bash ./install.sh "
+		command = fmt.Sprintf("%s ./install.sh ", p.Shell)
 	} else {
-		command = fmt.Sprintf("bash ./install.sh -v %s", p.Version)
+		command = fmt.Sprintf("%s ./install.sh -v %s", p.Shell, p.Version)
 	}
 
-	if err := p.runCommand(o, comm, p.linuxGetCommand(command)); err != nil {
+	if err := p.runNetworkCommand(o, comm, p.linuxGetCommand(command)); err != nil {
 		return err
 	}
 
@@ -95,146 +218,370 @@ func (p *provisioner) linuxInstallHabitat(o terraform.UIOutput, comm communicato
 	return p.runCommand(o, comm, p.linuxGetCommand("rm -f install.sh"))
 }
 
+// This returns the installed hab CLI release, or an empty string when hab is missing
+func (p *provisioner) linuxHabitatVersion(o terraform.UIOutput, comm communicator.Communicator) string {
+	output, err := p.runCommandOutput(o, comm, p.linuxGetCommand("hab --version 2>/dev/null"))
+	if err != nil {
+		return ""
+	}
+	return parseHabVersion(output)
+}
+
+// This checks whether a package (eg 'core/hab-sup/1.6.181') is already installed
+func (p *provisioner) linuxHabitatPackageInstalled(o terraform.UIOutput, comm communicator.Communicator, ident string) bool {
+	return p.runCommand(o, comm, p.linuxGetCommand(fmt.Sprintf("hab pkg path %s >/dev/null 2>&1", ident))) == nil
+}
+
+// This creates the hab user and group with the host's own tools, falling back to busybox from Builder on hosts
+// without getent, groupadd and useradd
 func (p *provisioner) createHabUser(o terraform.UIOutput, comm communicator.Communicator) error {
-	var addUser bool
+	if err := p.runCommand(o, comm, p.linuxGetCommand("command -v getent && command -v groupadd && command -v useradd")); err != nil {
+		return p.createHabUserBusybox(o, comm)
+	}
 
-	// Install busybox to get us the user tools we need
-	if err := p.runCommand(o, comm, p.linuxGetCommand("hab pkg install core/busybox")); err != nil {
+	var groupOptions, userOptions string
+	if p.GID > 0 {
+		groupOptions = fmt.Sprintf(" -g %d", p.GID)
+	}
+	if p.UID > 0 {
+		userOptions = fmt.Sprintf(" -u %d", p.UID)
+	}
+
+	command := fmt.Sprintf("getent group %s >/dev/null || groupadd%s %s", p.HabGroup, groupOptions, p.HabGroup)
+	if err := p.runCommand(o, comm, p.linuxGetCommand(command)); err != nil {
 		return err
 	}
 
+	command = fmt.Sprintf("getent passwd %s >/dev/null || useradd%s -g %s -M -s /bin/false %s", p.HabUser, userOptions, p.HabGroup, p.HabUser)
+	return p.runCommand(o, comm, p.linuxGetCommand(command))
+}
+
+func (p *provisioner) createHabUserBusybox(o terraform.UIOutput, comm communicator.Communicator) error {
+	// Install busybox to get us the user tools we need
+	if !p.linuxHabitatPackageInstalled(o, comm, "core/busybox") {
+		if err := p.runNetworkCommand(o, comm, p.linuxGetCommand("hab pkg install core/busybox")); err != nil {
+			return err
+		}
+	}
+
 	// Check for existing hab user
-	if err := p.runCommand(o, comm, p.linuxGetCommand("hab pkg exec core/busybox id hab")); err != nil {
-		o.Output("No existing hab user detected, creating...")
-		addUser = true
+	if err := p.runCommand(o, comm, p.linuxGetCommand(fmt.Sprintf("hab pkg exec core/busybox id %s", p.HabUser))); err == nil {
+		return nil
+	}
+
+	o.Output(fmt.Sprintf("No existing %s user detected, creating...", p.HabUser))
+
+	var options string
+	if p.UID > 0 {
+		options += fmt.Sprintf(" -u %d", p.UID)
 	}
 
-	if addUser {
-		return p.runCommand(o, comm, p.linuxGetCommand("hab pkg exec core/busybox adduser -D -g \"\" hab"))
+	// busybox adduser creates a matching group itself, so a group is only added when it differs or needs a fixed gid
+	if p.HabGroup != p.HabUser || p.GID > 0 {
+		var groupOptions string
+		if p.GID > 0 {
+			groupOptions = fmt.Sprintf(" -g %d", p.GID)
+		}
+
+		command := fmt.Sprintf("hab pkg exec core/busybox grep -q ^%s: /etc/group || hab pkg exec core/busybox addgroup%s %s", p.HabGroup, groupOptions, p.HabGroup)
+		if err := p.runCommand(o, comm, p.linuxGetCommand(command)); err != nil {
+			return err
+		}
+		options += fmt.Sprintf(" -G %s", p.HabGroup)
 	}
 
-	return nil
+	return p.runCommand(o, comm, p.linuxGetCommand(fmt.Sprintf("hab pkg exec core/busybox adduser -D -g \"\"%s %s", options, p.HabUser)))
 }
 
-func (p *provisioner) linuxStartHabitat(o terraform.UIOutput, comm communicator.Communicator) error {
-	// Install the supervisor first
-	var command string
-	if p.Version == "latest" {
-		command += p.linuxGetCommand("hab pkg install core/hab-sup")
-	} else {
-		command += p.linuxGetCommand(fmt.Sprintf("hab pkg install core/hab-sup/%s", p.Version))
+// This creates a private directory under staging_dir for the files uploaded during this run.  It is created as the
+// connecting user, since uploads never go through the become method.
+func (p *provisioner) linuxCreateStagingDir(o terraform.UIOutput, comm communicator.Communicator) error {
+	output, err := p.runCommandOutput(o, comm, fmt.Sprintf("umask 077 && mktemp -d %s", path.Join(p.StagingDir, "habitat.XXXXXXXX")))
+	if err != nil {
+		return fmt.Errorf("error creating a staging directory in %s: %v", p.StagingDir, err)
 	}
 
-	if err := p.runCommand(o, comm, command); err != nil {
-		return err
+	dir := strings.TrimSpace(output)
+	if dir == "" {
+		return fmt.Errorf("error creating a staging directory in %s: mktemp returned no path", p.StagingDir)
 	}
 
-	// Build up supervisor options
-	options := ""
-	if p.PermanentPeer {
-		options += " --permanent-peer"
+	if err := p.runCommand(o, comm, fmt.Sprintf("chmod 0700 %s", dir)); err != nil {
+		return err
 	}
 
-	if p.ListenCtl != "" {
-		options += fmt.Sprintf(" --listen-ctl %s", p.ListenCtl)
+	p.runDir = dir
+	return nil
+}
+
+// This removes the staging directory created for this run, along with anything left in it
+func (p *provisioner) linuxRemoveStagingDir(o terraform.UIOutput, comm communicator.Communicator) error {
+	if p.runDir == "" {
+		return nil
 	}
 
-	if p.ListenGossip != "" {
-		options += fmt.Sprintf(" --listen-gossip %s", p.ListenGossip)
+	if err := p.runCommand(o, comm, p.linuxGetCommand(fmt.Sprintf("rm -rf %s", p.runDir))); err != nil {
+		return err
 	}
 
-	if p.ListenHTTP != "" {
-		options += fmt.Sprintf(" --listen-http %s", p.ListenHTTP)
+	p.runDir = ""
+	return nil
+}
+
+// This returns the path a file is staged at before being moved into place
+func (p *provisioner) linuxStagingPath(name string) string {
+	if p.runDir != "" {
+		return path.Join(p.runDir, name)
 	}
+	return path.Join(p.StagingDir, name)
+}
 
-	if len(p.Peers) > 0 {
-		if len(p.Peers) == 1 {
-			options += fmt.Sprintf(" --peer %s", p.Peers[0])
-		} else {
-			options += fmt.Sprintf(" --peer %s", strings.Join(p.Peers, " --peer "))
-		}
+// Names under which the supervisor's ports are registered with firewalld (a service) and ufw (an application
+// profile), and the comment marking the provisioner's nftables rules
+const linuxFirewallName = "habitat"
+const linuxUfwProfile = "/etc/ufw/applications.d/" + linuxFirewallName
+const linuxNftComment = "habitat-supervisor"
+
+// linuxNftRemoveCommand deletes every nftables rule carrying linuxNftComment
+var linuxNftRemoveCommand = fmt.Sprintf(`for handle in $(nft -a list chain inet filter input | grep %s | sed "s/.*# handle //"); do nft delete rule inet filter input handle $handle; done`, linuxNftComment)
+
+// The nftables rules are also written to a file included from /etc/nftables.conf, so they survive a reboot
+const linuxNftConf = "/etc/nftables.conf"
+const linuxNftRulesFile = "/etc/nftables.d/" + linuxFirewallName + ".nft"
+
+var linuxNftIncludeCommand = fmt.Sprintf(`if [ -f %s ] && ! grep -qF %s %s; then echo "include \"%s\"" >> %s; fi`, linuxNftConf, linuxNftRulesFile, linuxNftConf, linuxNftRulesFile, linuxNftConf)
+var linuxNftUnpersistCommand = fmt.Sprintf(`rm -f %s; if [ -f %s ]; then sed -i "\|%s|d" %s; fi`, linuxNftRulesFile, linuxNftConf, linuxNftRulesFile, linuxNftConf)
+
+// The nftables rules go into the 'inet filter' table's input chain used by the stock nftables.conf of most
+// distributions.  Rules in a separate table can't override a drop policy there.
+const linuxDetectFirewallCommand = `if command -v firewall-cmd >/dev/null 2>&1 && firewall-cmd --state >/dev/null 2>&1; then echo firewalld; ` +
+	`elif command -v ufw >/dev/null 2>&1 && ufw status | grep -q "Status: active"; then echo ufw; ` +
+	`elif command -v nft >/dev/null 2>&1 && nft list chain inet filter input >/dev/null 2>&1; then echo nftables; fi`
+
+const ufwProfile = `[{{ .Name }}]
+title=Habitat Supervisor
+description=Habitat Supervisor gossip, HTTP gateway and control gateway listeners
+ports={{ .Ports }}
+`
+
+// linuxDetectFirewall returns the active host firewall ('firewalld', 'ufw' or 'nftables'), or an empty string if none
+func (p *provisioner) linuxDetectFirewall(o terraform.UIOutput, comm communicator.Communicator) (string, error) {
+	output, err := p.runCommandOutput(o, comm, p.linuxGetCommand(linuxDetectFirewallCommand))
+	if err != nil {
+		return "", err
 	}
+	return strings.TrimSpace(output), nil
+}
 
-	if p.RingKey != "" {
-		options += fmt.Sprintf(" --ring %s", p.RingKey)
+// This opens the exposed supervisor ports in the active host firewall.  The rules are grouped under a stable name, so
+// re-runs replace them and ports which are no longer exposed are closed.
+func (p *provisioner) linuxConfigureFirewall(o terraform.UIOutput, comm communicator.Communicator) error {
+	firewall, err := p.linuxDetectFirewall(o, comm)
+	if err != nil {
+		return err
 	}
 
-	if p.URL != "" {
-		options += fmt.Sprintf(" --url %s", p.URL)
+	ports := p.firewallPorts()
+	if len(ports) == 0 {
+		return p.linuxRemoveFirewallRules(o, comm, firewall)
 	}
 
-	if p.Channel != "" {
-		options += fmt.Sprintf(" --channel %s", p.Channel)
+	var commands []string
+	switch firewall {
+	case "firewalld":
+		commands = append(commands,
+			fmt.Sprintf("firewall-cmd --permanent --info-service=%s >/dev/null 2>&1 || firewall-cmd --permanent --new-service=%s", linuxFirewallName, linuxFirewallName),
+			fmt.Sprintf("for port in $(firewall-cmd --permanent --service=%s --get-ports); do firewall-cmd --permanent --service=%s --remove-port=$port; done", linuxFirewallName, linuxFirewallName),
+		)
+		for _, port := range ports {
+			commands = append(commands, fmt.Sprintf("firewall-cmd --permanent --service=%s --add-port=%d/%s", linuxFirewallName, port.Port, port.Protocol))
+		}
+		commands = append(commands,
+			fmt.Sprintf("firewall-cmd --permanent --add-service=%s", linuxFirewallName),
+			"firewall-cmd --reload",
+		)
+	case "ufw":
+		var profilePorts []string
+		for _, port := range ports {
+			profilePorts = append(profilePorts, fmt.Sprintf("%d/%s", port.Port, port.Protocol))
+		}
+
+		var buf bytes.Buffer
+		t := template.Must(template.New("ufwProfile").Parse(ufwProfile))
+		if err := t.Execute(&buf, map[string]string{"Name": linuxFirewallName, "Ports": strings.Join(profilePorts, "|")}); err != nil {
+			return err
+		}
+
+		if err := p.linuxUploadFile(o, comm, &buf, p.linuxStagingPath("ufw-"+linuxFirewallName), linuxUfwProfile, fmt.Sprintf("chmod 0644 %s", linuxUfwProfile)); err != nil {
+			return err
+		}
+
+		commands = append(commands,
+			fmt.Sprintf("ufw app update %s", linuxFirewallName),
+			fmt.Sprintf("ufw allow %s", linuxFirewallName),
+		)
+	case "nftables":
+		var rules bytes.Buffer
+		commands = append(commands, linuxNftRemoveCommand)
+		for _, port := range ports {
+			rule := fmt.Sprintf("insert rule inet filter input %s dport %d accept comment %s", port.Protocol, port.Port, linuxNftComment)
+			commands = append(commands, "nft "+rule)
+			fmt.Fprintln(&rules, rule)
+		}
+
+		if err := p.runCommand(o, comm, p.linuxGetCommand(fmt.Sprintf("mkdir -p %s", path.Dir(linuxNftRulesFile)))); err != nil {
+			return err
+		}
+		if err := p.linuxUploadFile(o, comm, &rules, p.linuxStagingPath(path.Base(linuxNftRulesFile)), linuxNftRulesFile, fmt.Sprintf("chmod 0644 %s", linuxNftRulesFile)); err != nil {
+			return err
+		}
+		commands = append(commands, linuxNftIncludeCommand)
+	default:
+		o.Output("No active firewall found, skipping firewall configuration")
+		return nil
 	}
 
-	if p.Events != "" {
-		options += fmt.Sprintf(" --events %s", p.Events)
+	for _, command := range commands {
+		if err := p.runCommand(o, comm, p.linuxGetCommand(command)); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	if p.Organization != "" {
-		options += fmt.Sprintf(" --org %s", p.Organization)
+// linuxRemoveFirewall removes the rules opened by linuxConfigureFirewall from the active host firewall
+func (p *provisioner) linuxRemoveFirewall(o terraform.UIOutput, comm communicator.Communicator) error {
+	firewall, err := p.linuxDetectFirewall(o, comm)
+	if err != nil {
+		return err
 	}
+	return p.linuxRemoveFirewallRules(o, comm, firewall)
+}
 
-	if p.HttpDisable {
-		options += " --http-disable"
+func (p *provisioner) linuxRemoveFirewallRules(o terraform.UIOutput, comm communicator.Communicator, firewall string) error {
+	var command string
+	switch firewall {
+	case "firewalld":
+		command = fmt.Sprintf("if firewall-cmd --permanent --info-service=%s >/dev/null 2>&1; then firewall-cmd --permanent --remove-service=%s && firewall-cmd --permanent --delete-service=%s && firewall-cmd --reload; fi",
+			linuxFirewallName, linuxFirewallName, linuxFirewallName)
+	case "ufw":
+		command = fmt.Sprintf("if [ -f %s ]; then ufw delete allow %s; rm -f %s; fi", linuxUfwProfile, linuxFirewallName, linuxUfwProfile)
+	case "nftables":
+		command = linuxNftRemoveCommand + "; " + linuxNftUnpersistCommand
+	default:
+		o.Output("No active firewall found, skipping firewall rule removal")
+		return nil
 	}
 
-	if p.AutoUpdate {
-		options += " --auto-update"
+	return p.runCommand(o, comm, p.linuxGetCommand(command))
+}
+
+func (p *provisioner) linuxStartHabitat(o terraform.UIOutput, comm communicator.Communicator) error {
+	// Install the supervisor first, unless the requested release is already present
+	ident := "core/hab-sup"
+	if p.Version != "latest" {
+		ident = fmt.Sprintf("core/hab-sup/%s", p.Version)
 	}
 
-	if p.EventStream != nil {
-		options += p.EventStream.FlagValues()
+	if p.linuxHabitatPackageInstalled(o, comm, ident) {
+		o.Output(fmt.Sprintf("%s is already installed", ident))
+	} else if err := p.runNetworkCommand(o, comm, p.linuxGetCommand(fmt.Sprintf("hab pkg install %s", ident))); err != nil {
+		return err
 	}
 
-	options += " --no-color"
+	if p.ManageFirewall {
+		if err := p.linuxConfigureFirewall(o, comm); err != nil {
+			return err
+		}
+	}
 
+	// Build up supervisor options
+	options := p.supervisorArgs().linux()
 	p.SupOptions = options
 
 	// Start hab depending on service type
+	var err error
 	switch p.ServiceType {
 	case "unmanaged":
-		return p.linuxStartHabitatUnmanaged(o, comm, options)
+		err = p.linuxStartHabitatUnmanaged(o, comm, options)
 	case "systemd":
-		return p.linuxStartHabitatSystemd(o, comm, options)
+		err = p.linuxStartHabitatSystemd(o, comm, options)
 	default:
 		return errors.New("unsupported service type")
 	}
+	if err != nil {
+		return err
+	}
+
+	return p.linuxWaitForSupervisor(o, comm)
+}
+
+// This polls the ctl gateway until the supervisor answers, or the readiness timeout expires.  On timeout, the error
+// carries the end of the supervisor's log, so the cause shows up in the Terraform output.
+func (p *provisioner) linuxWaitForSupervisor(o terraform.UIOutput, comm communicator.Communicator) error {
+	attempts := (p.ReadinessTimeout + 4) / 5
+	command := fmt.Sprintf("i=0; until hab svc status%s >/dev/null 2>&1; do i=$((i+1)); if [ $i -ge %d ]; then exit 1; fi; echo \"Waiting for Habitat to start ...\"; sleep 5; done", p.getRemoteSupOption(), attempts)
+	if err := p.runCommand(o, comm, p.linuxGetCommand(command)); err == nil {
+		return nil
+	}
+
+	logCommand := fmt.Sprintf("tail -n 50 %s", linuxSupLogFile)
+	if p.ServiceType == "systemd" {
+		logCommand = fmt.Sprintf("journalctl -u %s -n 50 --no-pager", p.ServiceName)
+	}
+
+	logs, err := p.runCommandOutput(o, comm, p.linuxGetCommand(logCommand))
+	if err != nil {
+		logs = fmt.Sprintf("(unable to collect the supervisor log: %v)", err)
+	}
+
+	return fmt.Errorf("the Habitat supervisor did not become ready within %ds, the end of its log follows:\n%s", p.ReadinessTimeout, p.redact(strings.TrimSpace(logs)))
 }
 
-// This func is a little different than the others since we need to expose HAB_AUTH_TOKEN to a shell
-// sub-process that's actually running the supervisor.
+// This runs the supervisor in the background, tracked by a pidfile.  Its environment and options are written to a run
+// script, and a running supervisor is only restarted when that script changed or the process is gone.
 func (p *provisioner) linuxStartHabitatUnmanaged(o terraform.UIOutput, comm communicator.Communicator, options string) error {
-	var token string
-	var license string
+	// Create the sup directory for the run script, pidfile and log file
+	if err := p.runCommand(o, comm, p.linuxGetCommand(fmt.Sprintf("mkdir -p %s", path.Dir(linuxSupRunScript)))); err != nil {
+		return err
+	}
 
-	// Create the sup directory for the log file
-	if err := p.runCommand(o, comm, p.linuxGetCommand("mkdir -p /hab/sup/default && chmod o+w /hab/sup/default")); err != nil {
+	script := p.linuxStagingPath("start-habitat-unmanaged.sh")
+	if err := comm.Upload(script, strings.NewReader(startHabitatUnmanagedScript)); err != nil {
 		return err
 	}
 
-	// Set HAB_AUTH_TOKEN if provided
-	if p.BuilderAuthToken != "" {
-		token = fmt.Sprintf("env HAB_AUTH_TOKEN=%s ", p.BuilderAuthToken)
+	var env string
+	for _, v := range p.SupervisorEnvironment() {
+		env += " " + v.linux()
 	}
 
-	// Set HAB_LICENSE if provided
-	if p.License != "" {
-		license = fmt.Sprintf("HAB_LICENSE=%s ", p.License)
+	run := fmt.Sprintf(unmanagedRunScript, env, options)
+	tempRun := p.linuxStagingPath(path.Base(linuxSupRunScript))
+	if err := comm.Upload(tempRun, strings.NewReader(run)); err != nil {
+		return err
+	}
+
+	// Check for (re)start
+	checksum := sha256.Sum256([]byte(run))
+	notePlan(comm, fmt.Sprintf("The supervisor is only (re)started if %s doesn't match checksum %x, or it isn't running", linuxSupRunScript, checksum))
+	if err := p.runCommand(o, comm, p.linuxGetCommand(fmt.Sprintf("%s %s \"%s\" \"%s\" \"%x\" \"%s\" \"%s\"", p.Shell, script, linuxSupRunScript, tempRun, checksum, linuxSupPidFile, linuxSupLogFile))); err != nil {
+		return err
 	}
 
-	return p.runCommand(o, comm, p.linuxGetCommand(fmt.Sprintf("(env %s%s setsid hab sup run%s > /hab/sup/default/sup.log 2>&1 <&1 &) ; sleep 1", token, license, options)))
+	return p.runCommand(o, comm, p.linuxGetCommand(fmt.Sprintf("rm %s", script)))
 }
 
 func (p *provisioner) linuxStartHabitatSystemd(o terraform.UIOutput, comm communicator.Communicator, options string) error {
 	// Upload script
-	if err := comm.Upload("/tmp/re-start-habitat.sh", strings.NewReader(startHabitatScript)); err != nil {
+	script := p.linuxStagingPath("re-start-habitat.sh")
+	if err := comm.Upload(script, strings.NewReader(startHabitatScript)); err != nil {
 		return err
 	}
 
 	// Create a new template and parse the client config into it
 	unitString := template.Must(template.New(fmt.Sprintf("%s.service", p.ServiceName)).Parse(systemdUnit))
-	tempDestination := fmt.Sprintf("/tmp/%s.service", p.ServiceName)
+	tempDestination := p.linuxStagingPath(fmt.Sprintf("%s.service", p.ServiceName))
 	destination := fmt.Sprintf("/etc/systemd/system/%s.service", p.ServiceName)
 
 	// Checksum for unit string
@@ -245,6 +592,11 @@ func (p *provisioner) linuxStartHabitatSystemd(o terraform.UIOutput, comm commun
 		return fmt.Errorf("error executing %s.service template: %s", p.ServiceName, err)
 	}
 
+	// The drop-in is part of the checksum, so changing (or removing) it restarts the supervisor too
+	dropInDestination := fmt.Sprintf("%s.d/%s", destination, systemdDropInName)
+	tempDropInDestination := ""
+	checksumBuf.WriteString(p.Systemd.DropInContent)
+
 	hash := sha256.New()
 	if _, err := io.Copy(hash, bytes.NewReader(checksumBuf.Bytes())); err != nil {
 		return err
@@ -255,8 +607,16 @@ func (p *provisioner) linuxStartHabitatSystemd(o terraform.UIOutput, comm commun
 		return err
 	}
 
+	if p.Systemd.DropInContent != "" {
+		tempDropInDestination = p.linuxStagingPath(systemdDropInName)
+		if err := comm.Upload(tempDropInDestination, strings.NewReader(p.Systemd.DropInContent)); err != nil {
+			return err
+		}
+	}
+
 	// Check for (re)start
-	if err := p.runCommand(o, comm, p.linuxGetCommand(fmt.Sprintf("bash /tmp/re-start-habitat.sh \"%s.service\" \"%s\" \"%s\" \"%x\"", p.ServiceName, destination, tempDestination, newChecksum))); err != nil {
+	notePlan(comm, fmt.Sprintf("%s.service is only restarted if %s and its drop-in don't match checksum %x", p.ServiceName, destination, newChecksum))
+	if err := p.runCommand(o, comm, p.linuxGetCommand(fmt.Sprintf("%s %s \"%s.service\" \"%s\" \"%s\" \"%x\" \"%s\" \"%s\"", p.Shell, script, p.ServiceName, destination, tempDestination, newChecksum, dropInDestination, tempDropInDestination))); err != nil {
 		return err
 	}
 
@@ -265,7 +625,7 @@ func (p *provisioner) linuxStartHabitatSystemd(o terraform.UIOutput, comm commun
 		return err
 	}
 
-	return p.runCommand(o, comm, p.linuxGetCommand("rm /tmp/re-start-habitat.sh"))
+	return p.runCommand(o, comm, p.linuxGetCommand(fmt.Sprintf("rm %s", script)))
 }
 
 func (p *provisioner) linuxUploadSystemdUnit(o terraform.UIOutput, comm communicator.Communicator, tempDestination string, contents *bytes.Buffer) error {
@@ -273,7 +633,24 @@ func (p *provisioner) linuxUploadSystemdUnit(o terraform.UIOutput, comm communic
 }
 
 func (p *provisioner) linuxUploadRingKey(o terraform.UIOutput, comm communicator.Communicator) error {
-	return p.runCommand(o, comm, p.linuxGetCommand(fmt.Sprintf(`echo -e "%s" | hab ring key import`, p.RingKeyContent)))
+	return p.runCommand(o, comm, p.linuxGetCommand(fmt.Sprintf(`printf "%%s\n" "%s" | hab ring key import`, p.RingKeyContent)))
+}
+
+// This uploads the custom CA bundle into the hab ssl cache, where hab adds it to the certificates it trusts, and
+// appends it to a copy of the system trust store for curl
+func (p *provisioner) linuxUploadCABundle(o terraform.UIOutput, comm communicator.Communicator) error {
+	if err := p.runCommand(o, comm, p.linuxGetCommand(fmt.Sprintf("mkdir -p %s", linuxCABundleDir))); err != nil {
+		return err
+	}
+
+	destination := path.Join(linuxCABundleDir, caBundleName)
+	if err := p.linuxUploadFile(o, comm, strings.NewReader(p.CABundleContent), p.linuxStagingPath(caBundleName), destination, fmt.Sprintf("chmod 0644 %s", destination)); err != nil {
+		return err
+	}
+
+	command := fmt.Sprintf("for f in %s; do if [ -f $f ]; then cat $f; break; fi; done > %s && cat %s >> %s && chmod 0644 %s",
+		linuxSystemCABundles, linuxCurlCABundle, destination, linuxCurlCABundle, linuxCurlCABundle)
+	return p.runCommand(o, comm, p.linuxGetCommand(command))
 }
 
 func (p *provisioner) linuxUploadCtlSecret(o terraform.UIOutput, comm communicator.Communicator) error {
@@ -284,26 +661,17 @@ func (p *provisioner) linuxUploadCtlSecret(o terraform.UIOutput, comm communicat
 		return err
 	}
 
-	keyContent := strings.NewReader(p.CtlSecret)
-	if p.UseSudo {
-		tempPath := "/tmp/CTL_SECRET"
-		if err := comm.Upload(tempPath, keyContent); err != nil {
-			return err
-		}
-
-		return p.runCommand(o, comm, p.linuxGetCommand(fmt.Sprintf("mv %s %s && chown root:root %s && chmod 0600 %s", tempPath, destination, destination, destination)))
+	// Without escalation the secret already belongs to the connecting user, who may not be able to hand it to root
+	finalize := fmt.Sprintf("chmod 0600 %s", destination)
+	if p.Become.escalates() {
+		finalize = fmt.Sprintf("chown root:root %s && %s", destination, finalize)
 	}
 
-	return comm.Upload(destination, keyContent)
+	keyContent := strings.NewReader(p.CtlSecret)
+	return p.linuxUploadFile(o, comm, keyContent, p.linuxStagingPath("CTL_SECRET"), destination, finalize)
 }
 
 func (p *provisioner) linuxStartHabitatService(o terraform.UIOutput, comm communicator.Communicator, service Service) error {
-	var options string
-
-	if err := p.linuxInstallHabitatPackage(o, comm, service); err != nil {
-		return err
-	}
-
 	if strings.TrimSpace(service.UserTOML) != "" {
 		if err := p.linuxUploadUserTOML(o, comm, service); err != nil {
 			return err
@@ -318,29 +686,7 @@ func (p *provisioner) linuxStartHabitatService(o terraform.UIOutput, comm commun
 		}
 	}
 
-	if service.Topology != "" {
-		options += fmt.Sprintf(" --topology %s", service.Topology)
-	}
-
-	if service.Strategy != "" {
-		options += fmt.Sprintf(" --strategy %s", service.Strategy)
-	}
-
-	if service.Channel != "" {
-		options += fmt.Sprintf(" --channel %s", service.Channel)
-	}
-
-	if service.URL != "" {
-		options += fmt.Sprintf(" --url %s", service.URL)
-	}
-
-	if service.Group != "" {
-		options += fmt.Sprintf(" --group %s", service.Group)
-	}
-
-	for _, bind := range service.Binds {
-		options += fmt.Sprintf(" --bind %s", bind.toBindString())
-	}
+	options := service.loadArgs().linux()
 
 	// If the svc is already loaded and we require re-loading, unload the service before continuing (don't care
 	// about errors at this point, since if it's not already running we just 'hab svc load' anyways)
@@ -352,7 +698,7 @@ func (p *provisioner) linuxStartHabitatService(o terraform.UIOutput, comm commun
 	// If the requested service is already loaded, skip re-loading it
 	if !service.Unload {
 		if err := p.linuxHabitatServiceLoaded(o, comm, service); err != nil {
-			return p.runCommand(o, comm, p.linuxGetCommand(fmt.Sprintf("hab svc load %s %s", service.Name, options)))
+			return p.runNetworkCommand(o, comm, p.linuxGetCommand(fmt.Sprintf("hab svc load%s %s %s", p.getRemoteSupOption(), service.Name, options)))
 		}
 	}
 
@@ -361,29 +707,63 @@ func (p *provisioner) linuxStartHabitatService(o terraform.UIOutput, comm commun
 
 // This is a check to see if a habitat svc is already loaded on the machine
 func (p *provisioner) linuxHabitatServiceLoaded(o terraform.UIOutput, comm communicator.Communicator, service Service) error {
-	return p.runCommand(o, comm, p.linuxGetCommand(fmt.Sprintf("hab svc status %s >/dev/null 2>&1", service.Name)))
+	return p.runCommand(o, comm, p.linuxGetCommand(fmt.Sprintf("hab svc status%s %s >/dev/null 2>&1", p.getRemoteSupOption(), service.Name)))
+}
+
+// linuxDiagnostics lists what is gathered into the support bundle, from the supervisor's log and unit to the services
+// it has loaded
+func (p *provisioner) linuxDiagnostics() []diagnostic {
+	logCommand := fmt.Sprintf("tail -n 200 %s 2>&1", linuxSupLogFile)
+	unitCommand := fmt.Sprintf("cat %s 2>&1", linuxSupRunScript)
+	if p.ServiceType == "systemd" {
+		unit := fmt.Sprintf("/etc/systemd/system/%s.service", p.ServiceName)
+		logCommand = fmt.Sprintf("journalctl -u %s -n 200 --no-pager 2>&1", p.ServiceName)
+		unitCommand = fmt.Sprintf("cat %s; cat %s.d/%s 2>/dev/null; true", unit, unit, systemdDropInName)
+	}
+
+	diagnostics := []diagnostic{
+		{"hab --version", "hab --version 2>&1"},
+		{"hab svc status", fmt.Sprintf("hab svc status%s 2>&1", p.getRemoteSupOption())},
+		{"census", fmt.Sprintf("curl -s%s %s/census 2>&1", p.linuxGatewayAuthHeader(), p.getGatewayURL())},
+		{"service specs", "for f in /hab/sup/default/specs/*.spec; do echo \"==> $f\"; cat \"$f\"; done 2>&1"},
+		{"supervisor log", logCommand},
+		{"supervisor unit", unitCommand},
+	}
+
+	for i, d := range diagnostics {
+		diagnostics[i].Command = p.linuxGetCommand(d.Command)
+	}
+	return diagnostics
+}
+
+// This polls the HTTP gateway until the service reports a healthy status, or the service's health timeout expires
+func (p *provisioner) linuxWaitForServiceHealth(o terraform.UIOutput, comm communicator.Communicator, service Service) error {
+	attempts := (service.HealthTimeout + 4) / 5
+	command := fmt.Sprintf("i=0; while [ $i -lt %d ]; do curl -sf%s %s >/dev/null && exit 0; i=$((i+1)); sleep 5; done; echo \"Timed out waiting for %s to become healthy\"; exit 1", attempts, p.linuxGatewayAuthHeader(), p.getHealthURL(service), service.Name)
+	return p.runCommand(o, comm, p.linuxGetCommand(command))
+}
+
+// This returns the curl option authenticating with the HTTP gateway, which rejects other requests once
+// gateway_auth_token is set
+func (p *provisioner) linuxGatewayAuthHeader() string {
+	if p.GatewayAuthToken == "" {
+		return ""
+	}
+	return fmt.Sprintf(" -H \"Authorization: Bearer %s\"", p.GatewayAuthToken)
 }
 
 // This will quietly unload a habitat svc, ignoring any errors
 func (p *provisioner) linuxHabitatServiceUnload(o terraform.UIOutput, comm communicator.Communicator, service Service) error {
-	return p.runCommand(o, comm, p.linuxGetCommand(fmt.Sprintf("hab svc unload %s > /dev/null 2>&1 ; sleep 3", service.Name)))
+	return p.runCommand(o, comm, p.linuxGetCommand(fmt.Sprintf("hab svc unload%s %s > /dev/null 2>&1 ; sleep 3", p.getRemoteSupOption(), service.Name)))
 }
 
 // In the future we'll remove the dedicated install once the synchronous load feature in hab-sup is
 // available. Until then we install here to provide output and a noisy failure mechanism because
 // if you install with the pkg load, it occurs asynchronously and fails quietly.
 func (p *provisioner) linuxInstallHabitatPackage(o terraform.UIOutput, comm communicator.Communicator, service Service) error {
-	var options string
+	options := service.installArgs().linux()
 
-	if service.Channel != "" {
-		options += fmt.Sprintf(" --channel %s", service.Channel)
-	}
-
-	if service.URL != "" {
-		options += fmt.Sprintf(" --url %s", service.URL)
-	}
-
-	return p.runCommand(o, comm, p.linuxGetCommand(fmt.Sprintf("hab pkg install %s %s", service.Name, options)))
+	return p.runNetworkCommand(o, comm, p.linuxGetCommand(fmt.Sprintf("hab pkg install %s %s", service.Name, options)))
 }
 
 func (p *provisioner) linuxUploadServiceGroupKey(o terraform.UIOutput, comm communicator.Communicator, service Service) error {
@@ -393,16 +773,7 @@ func (p *provisioner) linuxUploadServiceGroupKey(o terraform.UIOutput, comm comm
 	destPath := path.Join("/hab/cache/keys", keyFileName)
 	keyContent := strings.NewReader(service.ServiceGroupKey)
 
-	if p.UseSudo {
-		tempPath := path.Join("/tmp", keyFileName)
-		if err := comm.Upload(tempPath, keyContent); err != nil {
-			return err
-		}
-
-		return p.runCommand(o, comm, p.linuxGetCommand(fmt.Sprintf("mv %s %s", tempPath, destPath)))
-	}
-
-	return comm.Upload(destPath, keyContent)
+	return p.linuxUploadFile(o, comm, keyContent, p.linuxStagingPath(keyFileName), destPath, "")
 }
 
 func (p *provisioner) linuxUploadUserTOML(o terraform.UIOutput, comm communicator.Communicator, service Service) error {
@@ -415,37 +786,59 @@ func (p *provisioner) linuxUploadUserTOML(o terraform.UIOutput, comm communicato
 	}
 
 	userToml := strings.NewReader(service.UserTOML)
+	tempPath := p.linuxStagingPath(fmt.Sprintf("user-%s.toml", service.getServiceNameChecksum()))
 
-	if p.UseSudo {
-		if err := comm.Upload(fmt.Sprintf("/tmp/user-%s.toml", service.getServiceNameChecksum()), userToml); err != nil {
-			return err
-		}
-		command = p.linuxGetCommand(fmt.Sprintf("mv /tmp/user-%s.toml %s/user.toml", service.getServiceNameChecksum(), destDir))
-		return p.runCommand(o, comm, command)
-	}
-
-	return comm.Upload(path.Join(destDir, "user.toml"), userToml)
+	return p.linuxUploadFile(o, comm, userToml, tempPath, path.Join(destDir, "user.toml"), "")
 }
 
 func (p *provisioner) linuxGetCommand(command string) string {
 	// Always set HAB_NONINTERACTIVE & HAB_NOCOLORING
-	env := "env HAB_NONINTERACTIVE=true HAB_NOCOLORING=true"
+	env := []string{"HAB_NONINTERACTIVE=true", "HAB_NOCOLORING=true"}
 
 	// Set license acceptance
 	if p.License != "" {
-		env += fmt.Sprintf(" HAB_LICENSE=%s", p.License)
+		env = append(env, fmt.Sprintf("HAB_LICENSE=%s", p.License))
 	}
 
 	// Set builder auth token
 	if p.BuilderAuthToken != "" {
-		env += fmt.Sprintf(" HAB_AUTH_TOKEN=%s", p.BuilderAuthToken)
+		env = append(env, fmt.Sprintf("HAB_AUTH_TOKEN=%s", p.BuilderAuthToken))
 	}
 
-	if p.UseSudo {
-		command = fmt.Sprintf("%s sudo -E /bin/bash -c '%s'", env, command)
-	} else {
-		command = fmt.Sprintf("%s /bin/bash -c '%s'", env, command)
+	// Route the installer and Builder traffic through the proxy
+	for _, e := range p.Proxy.Environment() {
+		env = append(env, e.linux())
 	}
 
-	return command
+	// Have curl trust the custom CA bundle, on top of the system trust store, while downloading the installer and hab
+	if p.CABundleContent != "" {
+		env = append(env, fmt.Sprintf("CURL_CA_BUNDLE=%s", linuxCurlCABundle))
+	}
+
+	return p.Become.wrap(env, fmt.Sprintf("%s -c '%s'", p.Shell, command))
+}
+
+// This uploads a file, staging it at tempPath and moving it into place through the become method when commands are
+// escalated, since uploads always run as the connecting user.  Any finalize command runs after the move, or directly
+// after the upload when not escalating.
+func (p *provisioner) linuxUploadFile(o terraform.UIOutput, comm communicator.Communicator, contents io.Reader, tempPath, destination, finalize string) error {
+	if !p.Become.escalates() {
+		if err := comm.Upload(destination, contents); err != nil {
+			return err
+		}
+		if finalize == "" {
+			return nil
+		}
+		return p.runCommand(o, comm, finalize)
+	}
+
+	if err := comm.Upload(tempPath, contents); err != nil {
+		return err
+	}
+
+	command := fmt.Sprintf("mv %s %s", tempPath, destination)
+	if finalize != "" {
+		command += " && " + finalize
+	}
+	return p.runCommand(o, comm, p.linuxGetCommand(command))
 }
@@ -0,0 +1,232 @@
+package habitat
+
+import (
+	"strconv"
+	"strings"
+)
+
+// habArg is a single 'hab' command line flag, optionally followed by a value.
+type habArg struct {
+	Flag  string
+	Value string
+}
+
+// habArgs is an ordered list of 'hab' command line flags.  Options are assembled once, independent of the target
+// OS, and only rendered into a command line string per platform.
+type habArgs []habArg
+
+func (a *habArgs) addFlag(flag string) {
+	*a = append(*a, habArg{Flag: flag})
+}
+
+func (a *habArgs) addValue(flag, value string) {
+	*a = append(*a, habArg{Flag: flag, Value: value})
+}
+
+// flags returns the flag names in order, used to compare the options honoured by each platform.
+func (a habArgs) flags() []string {
+	flags := make([]string, 0, len(a))
+	for _, arg := range a {
+		flags = append(flags, arg.Flag)
+	}
+	return flags
+}
+
+func (a habArgs) render(quote func(string) string) string {
+	var options string
+
+	for _, arg := range a {
+		options += " --" + arg.Flag
+		if arg.Value != "" {
+			options += " " + quote(arg.Value)
+		}
+	}
+
+	return options
+}
+
+// linux renders the args for use within a single-quoted 'sh -c' command or a systemd unit.
+func (a habArgs) linux() string {
+	return a.render(func(v string) string {
+		if strings.ContainsAny(v, " \t") {
+			return strconv.Quote(v)
+		}
+		return v
+	})
+}
+
+// windows renders the args for use within a single-quoted PowerShell string.
+func (a habArgs) windows() string {
+	return a.render(func(v string) string {
+		v = strings.ReplaceAll(v, "'", "''")
+		if strings.ContainsAny(v, " \t") {
+			return `"` + v + `"`
+		}
+		return v
+	})
+}
+
+// supervisorArgs builds the 'hab sup run' flags shared by every platform, so Linux and Windows supervisors are
+// always started with the same configuration.
+func (p *provisioner) supervisorArgs() habArgs {
+	var args habArgs
+
+	if p.PermanentPeer {
+		args.addFlag("permanent-peer")
+	}
+
+	if p.ListenCtl != "" {
+		args.addValue("listen-ctl", p.ListenCtl)
+	}
+
+	if p.ListenGossip != "" {
+		args.addValue("listen-gossip", p.ListenGossip)
+	}
+
+	if p.ListenHTTP != "" {
+		args.addValue("listen-http", p.ListenHTTP)
+	}
+
+	if p.SysIPAddress != "" {
+		args.addValue("sys-ip-address", p.SysIPAddress)
+	}
+
+	if p.LocalGossipMode {
+		args.addFlag("local-gossip-mode")
+	}
+
+	for _, peer := range p.Peers {
+		args.addValue("peer", peer)
+	}
+
+	if p.PeerWatchFile != "" {
+		args.addValue("peer-watch-file", p.PeerWatchFile)
+	}
+
+	if p.RingKey != "" {
+		args.addValue("ring", p.RingKey)
+	}
+
+	if p.CacheKeyPath != "" {
+		args.addValue("cache-key-path", p.CacheKeyPath)
+	}
+
+	if p.URL != "" {
+		args.addValue("url", p.URL)
+	}
+
+	if p.Channel != "" {
+		args.addValue("channel", p.Channel)
+	}
+
+	if p.Events != "" {
+		args.addValue("events", p.Events)
+	}
+
+	if p.Organization != "" {
+		args.addValue("org", p.Organization)
+	}
+
+	if p.HttpDisable {
+		args.addFlag("http-disable")
+	}
+
+	if p.AutoUpdate {
+		args.addFlag("auto-update")
+	}
+
+	if p.UpdateCondition != "" {
+		args.addValue("update-condition", p.UpdateCondition)
+	}
+
+	if p.KeepLatestPackages > 0 {
+		args.addValue("keep-latest-packages", strconv.Itoa(p.KeepLatestPackages))
+	}
+
+	if p.ServiceMinBackoffPeriod > 0 {
+		args.addValue("service-min-backoff-period", strconv.Itoa(p.ServiceMinBackoffPeriod))
+	}
+
+	if p.ServiceMaxBackoffPeriod > 0 {
+		args.addValue("service-max-backoff-period", strconv.Itoa(p.ServiceMaxBackoffPeriod))
+	}
+
+	if p.ServiceRestartCooldownPeriod > 0 {
+		args.addValue("service-restart-cooldown-period", strconv.Itoa(p.ServiceRestartCooldownPeriod))
+	}
+
+	if p.EventStream != nil {
+		args = append(args, p.EventStream.args()...)
+	}
+
+	args.addFlag("no-color")
+
+	return args
+}
+
+// installArgs builds the 'hab pkg install' flags for a service.
+func (s *Service) installArgs() habArgs {
+	var args habArgs
+
+	if s.Channel != "" {
+		args.addValue("channel", s.Channel)
+	}
+
+	if s.URL != "" {
+		args.addValue("url", s.URL)
+	}
+
+	return args
+}
+
+// loadArgs builds the 'hab svc load' flags for a service.
+func (s *Service) loadArgs() habArgs {
+	var args habArgs
+
+	if s.Topology != "" {
+		args.addValue("topology", s.Topology)
+	}
+
+	if s.Strategy != "" {
+		args.addValue("strategy", s.Strategy)
+	}
+
+	if s.Channel != "" {
+		args.addValue("channel", s.Channel)
+	}
+
+	if s.URL != "" {
+		args.addValue("url", s.URL)
+	}
+
+	if s.Group != "" {
+		args.addValue("group", s.Group)
+	}
+
+	for _, bind := range s.Binds {
+		args.addValue("bind", bind.toBindString())
+	}
+
+	return args
+}
+
+// SupervisorEnvironment returns the variables the supervisor runs with.  Every service type and platform starts the
+// supervisor with this same list, so settings passed through the environment behave the same everywhere.  Exported
+// for use by the systemd unit template.
+func (p *provisioner) SupervisorEnvironment() []envVar {
+	var env []envVar
+
+	if p.GatewayAuthToken != "" {
+		env = append(env, envVar{"HAB_SUP_GATEWAY_AUTH_TOKEN", p.GatewayAuthToken})
+	}
+
+	if p.BuilderAuthToken != "" {
+		env = append(env, envVar{"HAB_AUTH_TOKEN", p.BuilderAuthToken})
+	}
+
+	if p.License != "" {
+		env = append(env, envVar{"HAB_LICENSE", p.License})
+	}
+
+	return append(env, p.Proxy.Environment()...)
+}
@@ -0,0 +1,340 @@
+package habitat
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"unicode"
+
+	"github.com/hashicorp/terraform/communicator"
+	"github.com/hashicorp/terraform/communicator/remote"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestSupervisorArgs(t *testing.T) {
+	cases := map[string]struct {
+		Config  map[string]interface{}
+		Options string
+	}{
+		"Default options": {
+			Config:  map[string]interface{}{},
+			Options: " --no-color",
+		},
+		"Supervisor tuning options": {
+			Config: map[string]interface{}{
+				"listen_ctl":                      "0.0.0.0:9632",
+				"sys_ip_address":                  "10.0.0.5",
+				"local_gossip_mode":               true,
+				"peers":                           []interface{}{"1.2.3.4"},
+				"peer_watch_file":                 "/hab/peers",
+				"cache_key_path":                  "/hab/cache/keys",
+				"auto_update":                     true,
+				"update_condition":                "track-channel",
+				"keep_latest_packages":            2,
+				"service_min_backoff_period":      5,
+				"service_max_backoff_period":      60,
+				"service_restart_cooldown_period": 300,
+			},
+			Options: " --listen-ctl 0.0.0.0:9632 --sys-ip-address 10.0.0.5 --local-gossip-mode --peer 1.2.3.4 --peer-watch-file /hab/peers --cache-key-path /hab/cache/keys --auto-update --update-condition track-channel --keep-latest-packages 2 --service-min-backoff-period 5 --service-max-backoff-period 60 --service-restart-cooldown-period 300 --no-color",
+		},
+	}
+
+	for k, tc := range cases {
+		p, err := decodeConfig(
+			schema.TestResourceDataRaw(t, Provision().(*schema.Provisioner).Schema, tc.Config),
+		)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+
+		if options := p.supervisorArgs().linux(); options != tc.Options {
+			t.Fatalf("Test %q failed:\nexpected: %q\ngot:      %q", k, tc.Options, options)
+		}
+	}
+}
+
+func TestHabArgs_render(t *testing.T) {
+	args := habArgs{
+		{Flag: "permanent-peer"},
+		{Flag: "peer", Value: "1.2.3.4"},
+		{Flag: "event-meta", Value: "owner=o'brien team=ops"},
+	}
+
+	if linux := args.linux(); linux != ` --permanent-peer --peer 1.2.3.4 --event-meta "owner=o'brien team=ops"` {
+		t.Fatalf("unexpected linux rendering: %q", linux)
+	}
+
+	if windows := args.windows(); windows != ` --permanent-peer --peer 1.2.3.4 --event-meta "owner=o''brien team=ops"` {
+		t.Fatalf("unexpected windows rendering: %q", windows)
+	}
+}
+
+// The parity tests run each platform's implementation against a recording communicator and fail whenever a flag is
+// emitted on one OS but not the other.
+var parityConfig = map[string]interface{}{
+	"version":                         "latest",
+	"license":                         "accept-no-persist",
+	"service_type":                    "unmanaged",
+	"permanent_peer":                  true,
+	"listen_ctl":                      "0.0.0.0:9632",
+	"listen_gossip":                   "0.0.0.0:9638",
+	"listen_http":                     "0.0.0.0:9631",
+	"sys_ip_address":                  "10.0.0.5",
+	"local_gossip_mode":               true,
+	"peers":                           []interface{}{"1.2.3.4", "5.6.7.8"},
+	"peer_watch_file":                 "/hab/peers",
+	"ring_key":                        "test-ring",
+	"cache_key_path":                  "/hab/cache/keys",
+	"url":                             "https://bldr.example.org",
+	"channel":                         "stable",
+	"events":                          "eventsrv.default",
+	"organization":                    "my-org",
+	"http_disable":                    true,
+	"auto_update":                     true,
+	"update_condition":                "track-channel",
+	"keep_latest_packages":            2,
+	"service_min_backoff_period":      5,
+	"service_max_backoff_period":      60,
+	"service_restart_cooldown_period": 300,
+	"event_stream": []interface{}{
+		map[string]interface{}{
+			"application":     "my-application",
+			"environment":     "my-environment",
+			"connect_timeout": "30",
+			"meta": map[string]interface{}{
+				"my-key1": "my-val1",
+			},
+			"server_certificate": "dead-beef",
+			"site":               "my-site",
+			"token":              "ea7-beef",
+			"url":                "https://automate.example.org",
+		},
+	},
+	"service": []interface{}{
+		map[string]interface{}{
+			"name":     "core/foo",
+			"topology": "leader",
+			"strategy": "rolling",
+			"channel":  "unstable",
+			"group":    "prod",
+			"url":      "https://bldr.example.org",
+			"binds":    []interface{}{"backend:bar.default"},
+		},
+	},
+}
+
+func TestOptionParity_supervisor(t *testing.T) {
+	p, err := decodeConfig(
+		schema.TestResourceDataRaw(t, Provision().(*schema.Provisioner).Schema, parityConfig),
+	)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	o := new(terraform.MockUIOutput)
+
+	linux := newRecordingCommunicator()
+	if err := p.linuxStartHabitat(o, linux); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	windows := newRecordingCommunicator()
+	if err := p.windowsStartHabitat(o, windows); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	assertFlagParity(t, linux.flagsFor("sup run"), windows.flagsFor("HabService.dll.config"))
+}
+
+func TestOptionParity_service(t *testing.T) {
+	p, err := decodeConfig(
+		schema.TestResourceDataRaw(t, Provision().(*schema.Provisioner).Schema, parityConfig),
+	)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	o := new(terraform.MockUIOutput)
+
+	linux := newRecordingCommunicator()
+	windows := newRecordingCommunicator()
+	for _, s := range p.Services {
+		if err := p.linuxInstallHabitatPackage(o, linux, s); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if err := p.windowsInstallHabitatPackage(o, windows, s); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if err := p.linuxStartHabitatService(o, linux, s); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if err := p.windowsStartHabitatService(o, windows, s); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+
+	assertFlagParity(t, linux.flagsFor("pkg install core/foo"), windows.flagsFor("pkg install core/foo"))
+	assertFlagParity(t, linux.flagsFor("hab svc load"), windows.flagsFor("hab svc load"))
+}
+
+func assertFlagParity(t *testing.T, linux, windows []string) {
+	t.Helper()
+
+	if len(linux) == 0 {
+		t.Fatal("no flags were recorded")
+	}
+
+	if strings.Join(linux, " ") != strings.Join(windows, " ") {
+		t.Fatalf("option parity mismatch:\nlinux:   %v\nwindows: %v", linux, windows)
+	}
+}
+
+func TestSupervisorEnvironment_parity(t *testing.T) {
+	names := []string{"HAB_SUP_GATEWAY_AUTH_TOKEN", "HAB_AUTH_TOKEN", "HAB_LICENSE", "http_proxy", "HTTP_PROXY", "no_proxy", "NO_PROXY"}
+
+	cases := map[string]map[string]interface{}{
+		"License only": {
+			"license": "accept",
+		},
+		"Gateway and Builder tokens": {
+			"license":            "accept-no-persist",
+			"gateway_auth_token": "ea7-beef",
+			"builder_auth_token": "dead-beef",
+		},
+		"Proxy": {
+			"proxy": []interface{}{
+				map[string]interface{}{
+					"http_proxy": "http://proxy.example.com:3128",
+					"no_proxy":   "localhost,127.0.0.1",
+				},
+			},
+		},
+	}
+
+	for k, config := range cases {
+		o := new(terraform.MockUIOutput)
+		rendered := map[string]string{}
+
+		for _, serviceType := range []string{"systemd", "unmanaged"} {
+			config["service_type"] = serviceType
+			p, err := decodeConfig(
+				schema.TestResourceDataRaw(t, Provision().(*schema.Provisioner).Schema, config),
+			)
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+
+			c := newRecordingCommunicator()
+			if err := p.linuxStartHabitat(o, c); err != nil {
+				t.Fatalf("Test %q (%s) failed: %v", k, serviceType, err)
+			}
+			rendered[serviceType] = c.recorded("hab sup run")
+		}
+
+		delete(config, "service_type")
+		p, err := decodeConfig(
+			schema.TestResourceDataRaw(t, Provision().(*schema.Provisioner).Schema, config),
+		)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+
+		c := newRecordingCommunicator()
+		if err := p.windowsInstallHabitat(o, c); err != nil {
+			t.Fatalf("Test %q (windows) failed: %v", k, err)
+		}
+		if err := p.windowsStartHabitat(o, c); err != nil {
+			t.Fatalf("Test %q (windows) failed: %v", k, err)
+		}
+		rendered["windows"] = c.recorded("HabService.dll.config")
+
+		// The service's environment is the only place the gateway token is set
+		for _, command := range c.commands {
+			if command != rendered["windows"] && strings.Contains(command, "HAB_SUP_GATEWAY_AUTH_TOKEN") {
+				t.Fatalf("Test %q: windows sets the gateway token outside the service environment:\n%s", k, command)
+			}
+		}
+
+		expected := map[string]string{}
+		for _, v := range p.SupervisorEnvironment() {
+			expected[v.Name] = v.Value
+		}
+
+		for target, content := range rendered {
+			for _, name := range names {
+				value, ok := expected[name]
+				if ok && !strings.Contains(content, name+"="+value) {
+					t.Fatalf("Test %q: %s is missing %s=%s:\n%s", k, target, name, value, content)
+				}
+				if !ok && strings.Contains(content, name+"=") {
+					t.Fatalf("Test %q: %s unexpectedly sets %s:\n%s", k, target, name, content)
+				}
+			}
+		}
+	}
+}
+
+// recordingCommunicator accepts every command and upload, remembering what it was given.  Service status checks
+// fail so that services are always loaded.
+type recordingCommunicator struct {
+	communicator.MockCommunicator
+	commands []string
+}
+
+func newRecordingCommunicator() *recordingCommunicator {
+	c := &recordingCommunicator{}
+	c.CommandFunc = func(cmd *remote.Cmd) error {
+		c.commands = append(c.commands, cmd.Command)
+		if strings.Contains(cmd.Command, "hab svc status") && !strings.Contains(cmd.Command, "until hab svc status") {
+			cmd.SetExitStatus(1, nil)
+		} else {
+			cmd.SetExitStatus(0, nil)
+		}
+		return nil
+	}
+	return c
+}
+
+// Upload records the uploaded content alongside the commands, since some options end up in generated scripts
+func (c *recordingCommunicator) Upload(path string, input io.Reader) error {
+	content, err := ioutil.ReadAll(input)
+	if err != nil {
+		return err
+	}
+	c.commands = append(c.commands, string(content))
+	return nil
+}
+
+// recorded returns the first recorded command or upload containing marker.
+func (c *recordingCommunicator) recorded(marker string) string {
+	for _, command := range c.commands {
+		if strings.Contains(command, marker) {
+			return command
+		}
+	}
+	return ""
+}
+
+// flagsFor returns the flags of the first recorded command or upload containing marker.
+func (c *recordingCommunicator) flagsFor(marker string) []string {
+	var flags []string
+	for _, command := range c.commands {
+		if !strings.Contains(command, marker) {
+			continue
+		}
+		for _, field := range strings.Fields(command) {
+			if strings.HasPrefix(field, "--") {
+				if end := strings.IndexFunc(field, func(r rune) bool {
+					return r != '-' && !unicode.IsLetter(r)
+				}); end > 0 {
+					field = field[:end]
+				}
+				flags = append(flags, field)
+			}
+		}
+		return flags
+	}
+	return flags
+}
@@ -0,0 +1,37 @@
+package habitat
+
+import (
+	"sync"
+
+	"github.com/hashicorp/terraform/terraform"
+)
+
+// syncOutput serializes writes to a UIOutput shared by concurrently running phases
+type syncOutput struct {
+	sync.Mutex
+	o terraform.UIOutput
+}
+
+func newSyncOutput(o terraform.UIOutput) *syncOutput {
+	return &syncOutput{o: o}
+}
+
+func (s *syncOutput) Output(line string) {
+	s.Lock()
+	defer s.Unlock()
+	s.o.Output(line)
+}
+
+// prefixedOutput tags every line with a prefix (eg the service name), so interleaved output stays readable
+type prefixedOutput struct {
+	o      terraform.UIOutput
+	prefix string
+}
+
+func newPrefixedOutput(o terraform.UIOutput, prefix string) *prefixedOutput {
+	return &prefixedOutput{o: o, prefix: prefix}
+}
+
+func (p *prefixedOutput) Output(line string) {
+	p.o.Output(p.prefix + line)
+}
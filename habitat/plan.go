@@ -0,0 +1,189 @@
+package habitat
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/terraform/communicator"
+	"github.com/hashicorp/terraform/communicator/remote"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+// PlanStep is one remote operation recorded during a dry run
+type PlanStep struct {
+	// Kind is 'command', 'upload' or 'note'
+	Kind string
+
+	// Target is the command line for a command, and the destination path for an upload
+	Target string
+
+	// Content is the rendered file for an upload, and the explanation for a note
+	Content string
+}
+
+func (s PlanStep) String() string {
+	switch s.Kind {
+	case "command":
+		return "run: " + s.Target
+	case "upload":
+		return fmt.Sprintf("upload: %s\n%s", s.Target, strings.TrimRight(s.Content, "\r\n"))
+	default:
+		return "note: " + s.Content
+	}
+}
+
+// Plan decodes a provisioner configuration, keyed as it would be written in HCL, and returns the ordered remote
+// operations applying it would perform on the target described by connInfo, without connecting to it
+func Plan(raw map[string]interface{}, connInfo map[string]string) ([]PlanStep, error) {
+	p, err := decodeRawConfig(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	platform, err := p.detectPlatform(connInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.plan(new(discardOutput), platform)
+}
+
+// decodeRawConfig validates and decodes a configuration which doesn't come from Terraform
+func decodeRawConfig(raw map[string]interface{}) (*provisioner, error) {
+	c := terraform.NewResourceConfigRaw(raw)
+
+	prov := Provision().(*schema.Provisioner)
+	if _, es := prov.Validate(c); len(es) > 0 {
+		msgs := make([]string, len(es))
+		for i, e := range es {
+			msgs[i] = e.Error()
+		}
+		return nil, errors.New(strings.Join(msgs, "\n"))
+	}
+
+	sm := schema.InternalMap(prov.Schema)
+	diff, err := sm.Diff(nil, c, nil, nil, true)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := sm.Data(nil, diff)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeConfig(d)
+}
+
+// dryRun prints each remote operation as it is planned, in place of running it
+func (p *provisioner) dryRun(o terraform.UIOutput, platform Platform) error {
+	o.Output("Dry run, nothing is changed on the target...")
+	_, err := p.plan(o, platform)
+	return err
+}
+
+// plan runs every phase against a communicator which records operations instead of performing them.  The target is
+// treated as freshly installed, so no service is loaded yet, and services are planned one at a time to keep the order
+// stable.
+func (p *provisioner) plan(o terraform.UIOutput, platform Platform) ([]PlanStep, error) {
+	p.Parallelism = 1
+
+	comm := &planCommunicator{o: o, redact: p.redact}
+	comm.record(PlanStep{Kind: "note", Content: "Installs and loads are planned for every package and service, but skipped on the target for those already in place"})
+
+	err := p.apply(o, comm, platform)
+	return comm.steps, err
+}
+
+// notePlan records a decision which is only made on the target, when the communicator is planning a dry run
+func notePlan(comm communicator.Communicator, note string) {
+	if pc, ok := comm.(*planCommunicator); ok {
+		pc.record(PlanStep{Kind: "note", Content: note})
+	}
+}
+
+// planProbe matches the checks for loaded services and installed packages, which are failed so every load and
+// install is planned, as on a freshly installed target
+var planProbe = regexp.MustCompile(`hab svc status (--remote-sup \S+ )?[\w.-]+/|hab pkg path `)
+
+// planCommunicator implements communicator.Communicator by recording each operation, and printing it when there is
+// somewhere to print to
+type planCommunicator struct {
+	sync.Mutex
+	o      terraform.UIOutput
+	redact func(string) string
+	steps  []PlanStep
+}
+
+func (c *planCommunicator) record(step PlanStep) {
+	c.Lock()
+	defer c.Unlock()
+	step.Target = c.redact(step.Target)
+	step.Content = c.redact(step.Content)
+	c.steps = append(c.steps, step)
+	c.o.Output(step.String())
+}
+
+func (c *planCommunicator) Connect(o terraform.UIOutput) error {
+	return nil
+}
+
+func (c *planCommunicator) Disconnect() error {
+	return nil
+}
+
+func (c *planCommunicator) Timeout() time.Duration {
+	return time.Minute
+}
+
+func (c *planCommunicator) ScriptPath() string {
+	return ""
+}
+
+func (c *planCommunicator) Start(cmd *remote.Cmd) error {
+	cmd.Init()
+	c.record(PlanStep{Kind: "command", Target: cmd.Command})
+
+	// The staging directory is named after mktemp's template, since its real name is only known on the target
+	if fields := strings.Fields(cmd.Command); strings.Contains(cmd.Command, "mktemp -d ") {
+		_, _ = cmd.Stdout.Write([]byte(fields[len(fields)-1] + "\n"))
+	}
+
+	if planProbe.MatchString(cmd.Command) {
+		cmd.SetExitStatus(1, nil)
+	} else {
+		cmd.SetExitStatus(0, nil)
+	}
+	return nil
+}
+
+func (c *planCommunicator) Upload(path string, input io.Reader) error {
+	content, err := ioutil.ReadAll(input)
+	if err != nil {
+		return err
+	}
+	c.record(PlanStep{Kind: "upload", Target: path, Content: string(content)})
+	return nil
+}
+
+func (c *planCommunicator) UploadScript(path string, input io.Reader) error {
+	return c.Upload(path, input)
+}
+
+func (c *planCommunicator) UploadDir(dst string, src string) error {
+	c.record(PlanStep{Kind: "upload", Target: dst, Content: fmt.Sprintf("(the contents of %s)", filepath.Clean(src))})
+	return nil
+}
+
+// discardOutput drops the provisioner's output, when the plan is returned rather than printed
+type discardOutput struct{}
+
+func (discardOutput) Output(string) {}
@@ -0,0 +1,251 @@
+package habitat
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/terraform/communicator"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+// Platform implements each provisioning phase for one kind of target.  applyFn only talks to the Platform that was
+// detected for the connection, so new targets can be supported by registering another implementation.
+type Platform interface {
+	// Name returns a short, human readable name for the platform (eg 'linux')
+	Name() string
+
+	// Detect reports whether the platform can provision a target reached through the given connection info
+	Detect(connInfo map[string]string) bool
+
+	// ConcurrentSessions reports whether the platform's communicator can run several commands at once
+	ConcurrentSessions() bool
+
+	// CreateStagingDir prepares a private location for files which are uploaded before being moved into place
+	CreateStagingDir(o terraform.UIOutput, comm communicator.Communicator) error
+
+	// RemoveStagingDir deletes the location created by CreateStagingDir
+	RemoveStagingDir(o terraform.UIOutput, comm communicator.Communicator) error
+
+	// UploadCABundle installs the custom CA bundle where hab, and the tools used to install it, will trust it
+	UploadCABundle(o terraform.UIOutput, comm communicator.Communicator) error
+
+	InstallHabitat(o terraform.UIOutput, comm communicator.Communicator) error
+
+	// HabitatVersion returns the installed hab release (eg '1.6.181/20201030172917'), or an empty string if unknown
+	HabitatVersion(o terraform.UIOutput, comm communicator.Communicator) string
+
+	UploadRingKey(o terraform.UIOutput, comm communicator.Communicator) error
+	UploadCtlSecret(o terraform.UIOutput, comm communicator.Communicator) error
+	UploadServiceGroupKey(o terraform.UIOutput, comm communicator.Communicator, service Service) error
+	InstallHabitatPackage(o terraform.UIOutput, comm communicator.Communicator, service Service) error
+	StartHabitat(o terraform.UIOutput, comm communicator.Communicator) error
+	StartHabitatService(o terraform.UIOutput, comm communicator.Communicator, service Service) error
+	UnloadHabitatService(o terraform.UIOutput, comm communicator.Communicator, service Service) error
+	HabitatServiceLoaded(o terraform.UIOutput, comm communicator.Communicator, service Service) error
+	WaitForServiceHealth(o terraform.UIOutput, comm communicator.Communicator, service Service) error
+
+	// RemoveFirewall deletes the firewall rules opened for the supervisor's listeners
+	RemoveFirewall(o terraform.UIOutput, comm communicator.Communicator) error
+
+	// Diagnostics lists the commands gathered into the support bundle when provisioning fails
+	Diagnostics() []diagnostic
+}
+
+// platformFactory creates a Platform bound to the decoded provisioner configuration
+type platformFactory func(p *provisioner) Platform
+
+// platforms is the registry of known platforms, consulted in registration order during detection
+var platforms []platformFactory
+
+func registerPlatform(f platformFactory) {
+	platforms = append(platforms, f)
+}
+
+func init() {
+	registerPlatform(newLinuxPlatform)
+	registerPlatform(newWindowsPlatform)
+}
+
+// detectPlatform returns the first registered platform able to handle the connection
+func (p *provisioner) detectPlatform(connInfo map[string]string) (Platform, error) {
+	for _, f := range platforms {
+		if platform := f(p); platform.Detect(connInfo) {
+			return platform, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unsupported connection type: %s", connInfo["type"])
+}
+
+type linuxPlatform struct {
+	p *provisioner
+}
+
+func newLinuxPlatform(p *provisioner) Platform {
+	return &linuxPlatform{p: p}
+}
+
+func (l *linuxPlatform) Name() string {
+	return "linux"
+}
+
+func (l *linuxPlatform) Detect(connInfo map[string]string) bool {
+	switch connInfo["type"] {
+	case "ssh", "":
+		return true
+	}
+	return false
+}
+
+// SSH multiplexes every command over its own session on the same connection
+func (l *linuxPlatform) ConcurrentSessions() bool {
+	return true
+}
+
+func (l *linuxPlatform) CreateStagingDir(o terraform.UIOutput, comm communicator.Communicator) error {
+	return l.p.linuxCreateStagingDir(o, comm)
+}
+
+func (l *linuxPlatform) RemoveStagingDir(o terraform.UIOutput, comm communicator.Communicator) error {
+	return l.p.linuxRemoveStagingDir(o, comm)
+}
+
+func (l *linuxPlatform) UploadCABundle(o terraform.UIOutput, comm communicator.Communicator) error {
+	return l.p.linuxUploadCABundle(o, comm)
+}
+
+func (l *linuxPlatform) InstallHabitat(o terraform.UIOutput, comm communicator.Communicator) error {
+	return l.p.linuxInstallHabitat(o, comm)
+}
+
+func (l *linuxPlatform) HabitatVersion(o terraform.UIOutput, comm communicator.Communicator) string {
+	return l.p.linuxHabitatVersion(o, comm)
+}
+
+func (l *linuxPlatform) UploadRingKey(o terraform.UIOutput, comm communicator.Communicator) error {
+	return l.p.linuxUploadRingKey(o, comm)
+}
+
+func (l *linuxPlatform) UploadCtlSecret(o terraform.UIOutput, comm communicator.Communicator) error {
+	return l.p.linuxUploadCtlSecret(o, comm)
+}
+
+func (l *linuxPlatform) UploadServiceGroupKey(o terraform.UIOutput, comm communicator.Communicator, service Service) error {
+	return l.p.linuxUploadServiceGroupKey(o, comm, service)
+}
+
+func (l *linuxPlatform) InstallHabitatPackage(o terraform.UIOutput, comm communicator.Communicator, service Service) error {
+	return l.p.linuxInstallHabitatPackage(o, comm, service)
+}
+
+func (l *linuxPlatform) StartHabitat(o terraform.UIOutput, comm communicator.Communicator) error {
+	return l.p.linuxStartHabitat(o, comm)
+}
+
+func (l *linuxPlatform) StartHabitatService(o terraform.UIOutput, comm communicator.Communicator, service Service) error {
+	return l.p.linuxStartHabitatService(o, comm, service)
+}
+
+func (l *linuxPlatform) UnloadHabitatService(o terraform.UIOutput, comm communicator.Communicator, service Service) error {
+	return l.p.linuxHabitatServiceUnload(o, comm, service)
+}
+
+func (l *linuxPlatform) HabitatServiceLoaded(o terraform.UIOutput, comm communicator.Communicator, service Service) error {
+	return l.p.linuxHabitatServiceLoaded(o, comm, service)
+}
+
+func (l *linuxPlatform) WaitForServiceHealth(o terraform.UIOutput, comm communicator.Communicator, service Service) error {
+	return l.p.linuxWaitForServiceHealth(o, comm, service)
+}
+
+func (l *linuxPlatform) RemoveFirewall(o terraform.UIOutput, comm communicator.Communicator) error {
+	return l.p.linuxRemoveFirewall(o, comm)
+}
+
+func (l *linuxPlatform) Diagnostics() []diagnostic {
+	return l.p.linuxDiagnostics()
+}
+
+type windowsPlatform struct {
+	p *provisioner
+}
+
+func newWindowsPlatform(p *provisioner) Platform {
+	return &windowsPlatform{p: p}
+}
+
+func (w *windowsPlatform) Name() string {
+	return "windows"
+}
+
+func (w *windowsPlatform) Detect(connInfo map[string]string) bool {
+	return connInfo["type"] == "winrm"
+}
+
+func (w *windowsPlatform) ConcurrentSessions() bool {
+	return false
+}
+
+// Files are uploaded straight to their destination on Windows, so nothing is staged
+func (w *windowsPlatform) CreateStagingDir(o terraform.UIOutput, comm communicator.Communicator) error {
+	return nil
+}
+
+func (w *windowsPlatform) RemoveStagingDir(o terraform.UIOutput, comm communicator.Communicator) error {
+	return nil
+}
+
+func (w *windowsPlatform) UploadCABundle(o terraform.UIOutput, comm communicator.Communicator) error {
+	return w.p.windowsUploadCABundle(o, comm)
+}
+
+func (w *windowsPlatform) InstallHabitat(o terraform.UIOutput, comm communicator.Communicator) error {
+	return w.p.windowsInstallHabitat(o, comm)
+}
+
+func (w *windowsPlatform) HabitatVersion(o terraform.UIOutput, comm communicator.Communicator) string {
+	return w.p.windowsHabitatVersion(o, comm)
+}
+
+func (w *windowsPlatform) UploadRingKey(o terraform.UIOutput, comm communicator.Communicator) error {
+	return w.p.windowsUploadRingKey(o, comm)
+}
+
+func (w *windowsPlatform) UploadCtlSecret(o terraform.UIOutput, comm communicator.Communicator) error {
+	return w.p.windowsUploadCtlSecret(o, comm)
+}
+
+func (w *windowsPlatform) UploadServiceGroupKey(o terraform.UIOutput, comm communicator.Communicator, service Service) error {
+	return w.p.windowsUploadServiceGroupKey(o, comm, service)
+}
+
+func (w *windowsPlatform) InstallHabitatPackage(o terraform.UIOutput, comm communicator.Communicator, service Service) error {
+	return w.p.windowsInstallHabitatPackage(o, comm, service)
+}
+
+func (w *windowsPlatform) StartHabitat(o terraform.UIOutput, comm communicator.Communicator) error {
+	return w.p.windowsStartHabitat(o, comm)
+}
+
+func (w *windowsPlatform) StartHabitatService(o terraform.UIOutput, comm communicator.Communicator, service Service) error {
+	return w.p.windowsStartHabitatService(o, comm, service)
+}
+
+func (w *windowsPlatform) UnloadHabitatService(o terraform.UIOutput, comm communicator.Communicator, service Service) error {
+	return w.p.windowsHabitatServiceUnload(o, comm, service)
+}
+
+func (w *windowsPlatform) HabitatServiceLoaded(o terraform.UIOutput, comm communicator.Communicator, service Service) error {
+	return w.p.windowsHabitatServiceLoaded(o, comm, service)
+}
+
+func (w *windowsPlatform) WaitForServiceHealth(o terraform.UIOutput, comm communicator.Communicator, service Service) error {
+	return w.p.windowsWaitForServiceHealth(o, comm, service)
+}
+
+func (w *windowsPlatform) RemoveFirewall(o terraform.UIOutput, comm communicator.Communicator) error {
+	return w.p.windowsRemoveFirewall(o, comm)
+}
+
+func (w *windowsPlatform) Diagnostics() []diagnostic {
+	return w.p.windowsDiagnostics()
+}
@@ -0,0 +1,304 @@
+package habitat
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/terraform/communicator"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestPlatform_detect(t *testing.T) {
+	cases := map[string]struct {
+		ConnInfo map[string]string
+		Platform string
+		Error    bool
+	}{
+		"Default connection": {ConnInfo: map[string]string{}, Platform: "linux"},
+		"SSH connection":     {ConnInfo: map[string]string{"type": "ssh"}, Platform: "linux"},
+		"WinRM connection":   {ConnInfo: map[string]string{"type": "winrm"}, Platform: "windows"},
+		"Unknown connection": {ConnInfo: map[string]string{"type": "telnet"}, Error: true},
+	}
+
+	for k, tc := range cases {
+		p, err := decodeConfig(
+			schema.TestResourceDataRaw(t, Provision().(*schema.Provisioner).Schema, map[string]interface{}{}),
+		)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+
+		platform, err := p.detectPlatform(tc.ConnInfo)
+		if tc.Error {
+			if err == nil {
+				t.Fatalf("Test %q: expected an error, got platform %q", k, platform.Name())
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %q failed: %v", k, err)
+		}
+		if platform.Name() != tc.Platform {
+			t.Fatalf("Test %q: expected platform %q, got %q", k, tc.Platform, platform.Name())
+		}
+	}
+}
+
+func TestProvisioner_apply(t *testing.T) {
+	cases := map[string]struct {
+		Config map[string]interface{}
+		Phases []string
+	}{
+		"Supervisor only": {
+			Config: map[string]interface{}{},
+			Phases: []string{"staging", "install", "version", "start", "cleanup"},
+		},
+		"Supervisor with keys and services": {
+			Config: map[string]interface{}{
+				"ca_bundle_content": "-----BEGIN CERTIFICATE-----",
+				"ring_key":          "test-ring",
+				"ring_key_content":  "dead-beef",
+				"ctl_secret":        "bad-beef",
+				"service": []interface{}{
+					map[string]interface{}{
+						"name": "core/foo",
+					},
+				},
+			},
+			Phases: []string{"staging", "ca-bundle", "install", "version", "ring-key", "ctl-secret", "start", "package core/foo", "service core/foo", "cleanup"},
+		},
+		"Services in dependency order": {
+			Config: map[string]interface{}{
+				"service": []interface{}{
+					map[string]interface{}{
+						"name":  "core/app",
+						"binds": []interface{}{"database:postgresql.default"},
+					},
+					map[string]interface{}{
+						"name":            "core/postgresql",
+						"wait_for_health": true,
+					},
+				},
+			},
+			Phases: []string{"staging", "install", "version", "start", "package core/postgresql", "package core/app", "service core/postgresql", "health core/postgresql", "service core/app", "cleanup"},
+		},
+		"Teardown": {
+			Config: map[string]interface{}{
+				"teardown": true,
+				"service": []interface{}{
+					map[string]interface{}{
+						"name": "core/foo",
+					},
+				},
+			},
+			Phases: []string{"firewall-removal"},
+		},
+	}
+
+	o := new(terraform.MockUIOutput)
+	c := new(communicator.MockCommunicator)
+
+	for k, tc := range cases {
+		p, err := decodeConfig(
+			schema.TestResourceDataRaw(t, Provision().(*schema.Provisioner).Schema, tc.Config),
+		)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+
+		platform := &fakePlatform{}
+		if err := p.apply(o, c, platform); err != nil {
+			t.Fatalf("Test %q failed: %v", k, err)
+		}
+
+		if strings.Join(platform.phases, ",") != strings.Join(tc.Phases, ",") {
+			t.Fatalf("Test %q: expected phases %v, got %v", k, tc.Phases, platform.phases)
+		}
+	}
+}
+
+func TestProvisioner_apply_parallel(t *testing.T) {
+	p, err := decodeConfig(
+		schema.TestResourceDataRaw(t, Provision().(*schema.Provisioner).Schema, map[string]interface{}{
+			"parallelism": 4,
+			"service": []interface{}{
+				map[string]interface{}{"name": "core/foo"},
+				map[string]interface{}{"name": "core/bar"},
+			},
+		}),
+	)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	o := &recordingOutput{}
+	if err := p.apply(o, new(communicator.MockCommunicator), &fakePlatform{concurrent: true}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	for _, line := range []string{"[core/foo] Installing package: core/foo", "[core/bar] Starting service: core/bar"} {
+		if !o.contains(line) {
+			t.Fatalf("expected output line %q, got %v", line, o.lines)
+		}
+	}
+
+	// Platforms without concurrent sessions fall back to sequential, unprefixed output
+	o = &recordingOutput{}
+	if err := p.apply(o, new(communicator.MockCommunicator), &fakePlatform{}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	if !o.contains("Starting service: core/bar") {
+		t.Fatalf("expected unprefixed output, got %v", o.lines)
+	}
+}
+
+func TestProvisioner_apply_incompatible_version(t *testing.T) {
+	p, err := decodeConfig(
+		schema.TestResourceDataRaw(t, Provision().(*schema.Provisioner).Schema, map[string]interface{}{
+			"license": "accept",
+		}),
+	)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	platform := &fakePlatform{version: "0.79.1/20190410220617"}
+	err = p.apply(new(terraform.MockUIOutput), new(communicator.MockCommunicator), platform)
+	if err == nil || !strings.Contains(err.Error(), "license requires Habitat 0.81.0 or newer") {
+		t.Fatalf("expected an incompatible version error, got %v", err)
+	}
+	if strings.Join(platform.phases, ",") != "staging,install,version,cleanup" {
+		t.Fatalf("expected provisioning to stop after the version check, got %v", platform.phases)
+	}
+}
+
+type recordingOutput struct {
+	sync.Mutex
+	lines []string
+}
+
+func (r *recordingOutput) Output(line string) {
+	r.Lock()
+	defer r.Unlock()
+	r.lines = append(r.lines, line)
+}
+
+func (r *recordingOutput) contains(line string) bool {
+	for _, l := range r.lines {
+		if l == line {
+			return true
+		}
+	}
+	return false
+}
+
+// fakePlatform records the phases it was asked to run, without touching a communicator
+type fakePlatform struct {
+	sync.Mutex
+	phases     []string
+	concurrent bool
+	version    string
+}
+
+func (f *fakePlatform) record(phase string) {
+	f.Lock()
+	defer f.Unlock()
+	f.phases = append(f.phases, phase)
+}
+
+func (f *fakePlatform) Name() string {
+	return "fake"
+}
+
+func (f *fakePlatform) Detect(connInfo map[string]string) bool {
+	return connInfo["type"] == "fake"
+}
+
+func (f *fakePlatform) ConcurrentSessions() bool {
+	return f.concurrent
+}
+
+func (f *fakePlatform) CreateStagingDir(o terraform.UIOutput, comm communicator.Communicator) error {
+	f.record("staging")
+	return nil
+}
+
+func (f *fakePlatform) RemoveStagingDir(o terraform.UIOutput, comm communicator.Communicator) error {
+	f.record("cleanup")
+	return nil
+}
+
+func (f *fakePlatform) UploadCABundle(o terraform.UIOutput, comm communicator.Communicator) error {
+	f.record("ca-bundle")
+	return nil
+}
+
+func (f *fakePlatform) InstallHabitat(o terraform.UIOutput, comm communicator.Communicator) error {
+	f.record("install")
+	return nil
+}
+
+func (f *fakePlatform) HabitatVersion(o terraform.UIOutput, comm communicator.Communicator) string {
+	f.record("version")
+	return f.version
+}
+
+func (f *fakePlatform) UploadRingKey(o terraform.UIOutput, comm communicator.Communicator) error {
+	f.record("ring-key")
+	return nil
+}
+
+func (f *fakePlatform) UploadCtlSecret(o terraform.UIOutput, comm communicator.Communicator) error {
+	f.record("ctl-secret")
+	return nil
+}
+
+func (f *fakePlatform) UploadServiceGroupKey(o terraform.UIOutput, comm communicator.Communicator, service Service) error {
+	f.record("service-key " + service.Name)
+	return nil
+}
+
+func (f *fakePlatform) InstallHabitatPackage(o terraform.UIOutput, comm communicator.Communicator, service Service) error {
+	f.record("package " + service.Name)
+	return nil
+}
+
+func (f *fakePlatform) StartHabitat(o terraform.UIOutput, comm communicator.Communicator) error {
+	f.record("start")
+	return nil
+}
+
+func (f *fakePlatform) StartHabitatService(o terraform.UIOutput, comm communicator.Communicator, service Service) error {
+	f.record("service " + service.Name)
+	return nil
+}
+
+func (f *fakePlatform) UnloadHabitatService(o terraform.UIOutput, comm communicator.Communicator, service Service) error {
+	f.record("unload " + service.Name)
+	return nil
+}
+
+func (f *fakePlatform) HabitatServiceLoaded(o terraform.UIOutput, comm communicator.Communicator, service Service) error {
+	f.record("status " + service.Name)
+	return nil
+}
+
+func (f *fakePlatform) WaitForServiceHealth(o terraform.UIOutput, comm communicator.Communicator, service Service) error {
+	f.record("health " + service.Name)
+	return nil
+}
+
+func (f *fakePlatform) RemoveFirewall(o terraform.UIOutput, comm communicator.Communicator) error {
+	f.record("firewall-removal")
+	return nil
+}
+
+func (f *fakePlatform) Diagnostics() []diagnostic {
+	return []diagnostic{
+		{"hab svc status", "hab svc status"},
+		{"supervisor log", "tail sup.log"},
+	}
+}
@@ -0,0 +1,113 @@
+package habitat
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// caBundleName is the file name the custom CA bundle is uploaded as, within the hab ssl cache directory
+const caBundleName = "terraform-provisioner-ca.pem"
+
+// envVar is an environment variable passed to remote commands or the supervisor
+type envVar struct {
+	Name  string
+	Value string
+}
+
+// safeShellValue matches values which need no quoting in a POSIX shell word
+var safeShellValue = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]*$`)
+
+// linux renders the variable as a 'KEY=value' shell word, quoting values with metacharacters (eg in credentials)
+func (e envVar) linux() string {
+	if safeShellValue.MatchString(e.Value) {
+		return fmt.Sprintf("%s=%s", e.Name, e.Value)
+	}
+	return fmt.Sprintf("%s=%s", e.Name, shellQuote(e.Value))
+}
+
+// Proxy holds the proxy settings used for the Habitat installer and Builder access
+type Proxy struct {
+	HTTPProxy  string
+	HTTPSProxy string
+	NoProxy    string
+}
+
+func getProxy(v []interface{}) Proxy {
+	var proxy Proxy
+	for _, rawProxyData := range v {
+		proxyData, ok := rawProxyData.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		proxy.HTTPProxy = proxyData["http_proxy"].(string)
+		proxy.HTTPSProxy = proxyData["https_proxy"].(string)
+		proxy.NoProxy = proxyData["no_proxy"].(string)
+	}
+	return proxy
+}
+
+// enabled reports whether any proxy is configured
+func (px Proxy) enabled() bool {
+	return px.HTTPProxy != "" || px.HTTPSProxy != ""
+}
+
+// Environment returns the proxy variables, in both spellings since curl only honours a lower case 'http_proxy'
+func (px Proxy) Environment() []envVar {
+	var env []envVar
+	for _, v := range []envVar{
+		{"http_proxy", px.HTTPProxy},
+		{"https_proxy", px.HTTPSProxy},
+		{"no_proxy", px.NoProxy},
+	} {
+		if v.Value != "" {
+			env = append(env, v, envVar{strings.ToUpper(v.Name), v.Value})
+		}
+	}
+	return env
+}
+
+// passwords returns the passwords embedded in the proxy URLs, both as written and decoded, so they can be masked
+func (px Proxy) passwords() []string {
+	var passwords []string
+	for _, address := range []string{px.HTTPProxy, px.HTTPSProxy} {
+		u, err := url.Parse(address)
+		if err != nil || u.User == nil {
+			continue
+		}
+		if password, ok := u.User.Password(); ok {
+			passwords = append(passwords, password)
+			if i := strings.Index(u.User.String(), ":"); i >= 0 {
+				passwords = append(passwords, u.User.String()[i+1:])
+			}
+		}
+	}
+	return passwords
+}
+
+// windowsWebProxy returns a PowerShell statement pointing Invoke-RestMethod and Invoke-WebRequest at the proxy.
+// Credentials embedded in the proxy URL are passed separately, since System.Net.WebProxy ignores them.
+func (px Proxy) windowsWebProxy() string {
+	address := px.HTTPSProxy
+	if address == "" {
+		address = px.HTTPProxy
+	}
+
+	credentials := ""
+	if u, err := url.Parse(address); err == nil && u.User != nil {
+		password, _ := u.User.Password()
+		credentials = fmt.Sprintf("$proxy.Credentials = New-Object System.Net.NetworkCredential('%s', '%s'); ",
+			windowsQuote(u.User.Username()), windowsQuote(password))
+		u.User = nil
+		address = u.String()
+	}
+
+	return fmt.Sprintf("$proxy = New-Object System.Net.WebProxy('%s', $true); %s[System.Net.WebRequest]::DefaultWebProxy = $proxy; ",
+		windowsQuote(address), credentials)
+}
+
+// windowsQuote escapes a value for use within a single-quoted PowerShell string
+func windowsQuote(v string) string {
+	return strings.ReplaceAll(v, "'", "''")
+}
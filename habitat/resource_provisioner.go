@@ -1,13 +1,16 @@
 package habitat
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/url"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/hashicorp/terraform/communicator"
@@ -46,19 +49,48 @@ type provisioner struct {
 	EventStream      *EventStream
 	SupOptions       string
 
-	installHabitat        provisionFn
-	startHabitat          provisionFn
-	uploadRingKey         provisionFn
-	uploadCtlSecret       provisionFn
-	uploadServiceGroupKey provisionServiceFn
-	startHabitatService   provisionServiceFn
-
-	osType string
+	KeepLatestPackages           int
+	SysIPAddress                 string
+	LocalGossipMode              bool
+	PeerWatchFile                string
+	CacheKeyPath                 string
+	UpdateCondition              string
+	ServiceMinBackoffPeriod      int
+	ServiceMaxBackoffPeriod      int
+	ServiceRestartCooldownPeriod int
+	Parallelism                  int
+	HabUser                      string
+	HabGroup                     string
+	UID                          int
+	GID                          int
+	Become                       Become
+	Shell                        string
+	StagingDir                   string
+	Proxy                        Proxy
+	CABundleContent              string
+	Retry                        Retry
+	ManageFirewall               bool
+	Teardown                     bool
+	WindowsServiceDebug          bool
+	WindowsServiceLogLevel       string
+	WindowsServiceUser           string
+	WindowsServicePassword       string
+	Systemd                      Systemd
+	ReadinessTimeout             int
+	DiagnosticsOnFailure         bool
+	DiagnosticsDir               string
+	DryRun                       bool
+
+	// runDir is the private staging directory created for the current run
+	runDir string
+
+	// secrets are masked wherever commands, errors or command output are displayed
+	secrets []string
+
+	// settings records which capability gated settings were given a non-default value
+	settings map[string]bool
 }
 
-type provisionFn func(terraform.UIOutput, communicator.Communicator) error
-type provisionServiceFn func(terraform.UIOutput, communicator.Communicator, Service) error
-
 func Provision() terraform.ResourceProvisioner {
 	return &schema.Provisioner{
 		Schema: map[string]*schema.Schema{
@@ -102,6 +134,185 @@ func Provision() terraform.ResourceProvisioner {
 				Optional: true,
 				Default:  true,
 			},
+			"shell": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "/bin/bash",
+			},
+			"staging_dir": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "/tmp",
+			},
+			"proxy": &schema.Schema{
+				Type:     schema.TypeList,
+				MaxItems: 1,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"http_proxy": &schema.Schema{
+							Type:      schema.TypeString,
+							Optional:  true,
+							Sensitive: true,
+						},
+						"https_proxy": &schema.Schema{
+							Type:      schema.TypeString,
+							Optional:  true,
+							Sensitive: true,
+						},
+						"no_proxy": &schema.Schema{
+							Type:     schema.TypeString,
+							Optional: true,
+						},
+					},
+				},
+				Optional: true,
+			},
+			"ca_bundle_content": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"retry": &schema.Schema{
+				Type:     schema.TypeList,
+				MaxItems: 1,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"attempts": &schema.Schema{
+							Type:         schema.TypeInt,
+							Optional:     true,
+							Default:      3,
+							ValidateFunc: validation.IntAtLeast(1),
+						},
+						"initial_backoff": &schema.Schema{
+							Type:         schema.TypeInt,
+							Optional:     true,
+							Default:      5,
+							ValidateFunc: validation.IntAtLeast(0),
+						},
+						"max_backoff": &schema.Schema{
+							Type:         schema.TypeInt,
+							Optional:     true,
+							Default:      60,
+							ValidateFunc: validation.IntAtLeast(0),
+						},
+						"exit_codes": &schema.Schema{
+							Type:     schema.TypeList,
+							Elem:     &schema.Schema{Type: schema.TypeInt},
+							Optional: true,
+						},
+						"output_patterns": &schema.Schema{
+							Type: schema.TypeList,
+							Elem: &schema.Schema{
+								Type:         schema.TypeString,
+								ValidateFunc: validation.ValidateRegexp,
+							},
+							Optional: true,
+						},
+					},
+				},
+				Optional: true,
+			},
+			"manage_firewall": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"teardown": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"windows_service_debug": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"windows_service_log_level": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validation.StringInSlice([]string{"ALL", "DEBUG", "INFO", "WARN", "ERROR", "FATAL", "OFF"}, false),
+			},
+			"windows_service_user": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"windows_service_password": &schema.Schema{
+				Type:      schema.TypeString,
+				Optional:  true,
+				Sensitive: true,
+			},
+			"readiness_timeout": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      300,
+				ValidateFunc: validation.IntAtLeast(1),
+			},
+			"systemd": &schema.Schema{
+				Type:     schema.TypeList,
+				MaxItems: 1,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"unit": &schema.Schema{
+							Type:     schema.TypeMap,
+							Elem:     &schema.Schema{Type: schema.TypeString},
+							Optional: true,
+						},
+						"service": &schema.Schema{
+							Type:     schema.TypeMap,
+							Elem:     &schema.Schema{Type: schema.TypeString},
+							Optional: true,
+						},
+						"environment": &schema.Schema{
+							Type:     schema.TypeMap,
+							Elem:     &schema.Schema{Type: schema.TypeString},
+							Optional: true,
+						},
+						"drop_in_content": &schema.Schema{
+							Type:     schema.TypeString,
+							Optional: true,
+						},
+					},
+				},
+				Optional: true,
+			},
+			"diagnostics_on_failure": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"diagnostics_dir": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"dry_run": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"become": &schema.Schema{
+				Type:     schema.TypeList,
+				MaxItems: 1,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"method": &schema.Schema{
+							Type:         schema.TypeString,
+							Optional:     true,
+							Default:      "sudo",
+							ValidateFunc: validation.StringInSlice([]string{"sudo", "doas", "su", "none"}, false),
+						},
+						"password": &schema.Schema{
+							Type:      schema.TypeString,
+							Optional:  true,
+							Sensitive: true,
+						},
+						"preserve_env": &schema.Schema{
+							Type:     schema.TypeList,
+							Elem:     &schema.Schema{Type: schema.TypeString},
+							Optional: true,
+						},
+					},
+				},
+				Optional: true,
+			},
 			"permanent_peer": &schema.Schema{
 				Type:     schema.TypeBool,
 				Optional: true,
@@ -167,6 +378,74 @@ func Provision() terraform.ResourceProvisioner {
 				Type:     schema.TypeString,
 				Optional: true,
 			},
+			"keep_latest_packages": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				ValidateFunc: validation.IntAtLeast(0),
+			},
+			"sys_ip_address": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"local_gossip_mode": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"peer_watch_file": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"cache_key_path": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"update_condition": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validation.StringInSlice([]string{"latest", "track-channel"}, false),
+			},
+			"service_min_backoff_period": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				ValidateFunc: validation.IntAtLeast(0),
+			},
+			"service_max_backoff_period": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				ValidateFunc: validation.IntAtLeast(0),
+			},
+			"service_restart_cooldown_period": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				ValidateFunc: validation.IntAtLeast(0),
+			},
+			"parallelism": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      1,
+				ValidateFunc: validation.IntAtLeast(1),
+			},
+			"hab_user": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "hab",
+			},
+			"hab_group": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "hab",
+			},
+			"uid": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				ValidateFunc: validation.IntAtLeast(1),
+			},
+			"gid": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				ValidateFunc: validation.IntAtLeast(1),
+			},
 			"event_stream": &schema.Schema{
 				Type:     schema.TypeSet,
 				MaxItems: 1,
@@ -313,6 +592,27 @@ func Provision() terraform.ResourceProvisioner {
 							Optional: true,
 							Default:  false,
 						},
+						"depends_on": &schema.Schema{
+							Type:     schema.TypeList,
+							Elem:     &schema.Schema{Type: schema.TypeString},
+							Optional: true,
+						},
+						"wait_for_health": &schema.Schema{
+							Type:     schema.TypeBool,
+							Optional: true,
+							Default:  false,
+						},
+						"health_timeout": &schema.Schema{
+							Type:         schema.TypeInt,
+							Optional:     true,
+							Default:      300,
+							ValidateFunc: validation.IntAtLeast(1),
+						},
+						"svc_user_password": &schema.Schema{
+							Type:      schema.TypeString,
+							Optional:  true,
+							Sensitive: true,
+						},
 					},
 				},
 				Optional: true,
@@ -333,33 +633,15 @@ func applyFn(ctx context.Context) error {
 		return err
 	}
 
-	// Automatically determine the OS type
-	switch t := s.Ephemeral.ConnInfo["type"]; t {
-	case "ssh", "":
-		p.osType = "linux"
-	case "winrm":
-		p.osType = "windows"
-	default:
-		return fmt.Errorf("unsupported connection type: %s", t)
-	}
-
-	switch p.osType {
-	case "linux":
-		p.installHabitat = p.linuxInstallHabitat
-		p.uploadRingKey = p.linuxUploadRingKey
-		p.uploadCtlSecret = p.linuxUploadCtlSecret
-		p.uploadServiceGroupKey = p.linuxUploadServiceGroupKey
-		p.startHabitat = p.linuxStartHabitat
-		p.startHabitatService = p.linuxStartHabitatService
-	case "windows":
-		p.installHabitat = p.windowsInstallHabitat
-		p.uploadRingKey = p.windowsUploadRingKey
-		p.uploadCtlSecret = p.windowsUploadCtlSecret
-		p.uploadServiceGroupKey = p.windowsUploadServiceGroupKey
-		p.startHabitat = p.windowsStartHabitat
-		p.startHabitatService = p.windowsStartHabitatService
-	default:
-		return fmt.Errorf("unsupported os type: %s", p.osType)
+	// Automatically determine the target platform
+	platform, err := p.detectPlatform(s.Ephemeral.ConnInfo)
+	if err != nil {
+		return err
+	}
+
+	// A dry run records what would be done instead of connecting
+	if p.DryRun {
+		return p.dryRun(o, platform)
 	}
 
 	// Get a new communicator
@@ -381,42 +663,158 @@ func applyFn(ctx context.Context) error {
 	}
 	defer comm.Disconnect() //nolint:errcheck
 
+	return p.apply(o, comm, platform)
+}
+
+// apply runs every provisioning phase against an already connected communicator
+func (p *provisioner) apply(o terraform.UIOutput, comm communicator.Communicator, platform Platform) (err error) {
+	// A destroy-time provisioner only removes what provisioning opened up on the host
+	if p.Teardown {
+		o.Output("Removing firewall rules...")
+		return platform.RemoveFirewall(o, comm)
+	}
+
+	// Gather a support bundle while the connection is still open, since the failing command's output rarely tells
+	// the whole story
+	if p.DiagnosticsOnFailure {
+		defer func() {
+			if err != nil {
+				p.collectDiagnostics(o, comm, platform, err)
+			}
+		}()
+	}
+
+	if err := platform.CreateStagingDir(o, comm); err != nil {
+		return err
+	}
+
+	// Remove staged files whether or not provisioning succeeded, without masking an earlier error
+	defer func() {
+		if cleanupErr := platform.RemoveStagingDir(o, comm); cleanupErr != nil {
+			if err == nil {
+				err = cleanupErr
+			} else {
+				o.Output(fmt.Sprintf("Failed to remove the staging directory: %v", cleanupErr))
+			}
+		}
+	}()
+
+	// The CA bundle is needed by the installer, so it goes up first
+	if p.CABundleContent != "" {
+		o.Output("Uploading CA bundle...")
+		if err := platform.UploadCABundle(o, comm); err != nil {
+			return err
+		}
+	}
+
 	if !p.SkipInstall {
 		o.Output("Installing habitat...")
-		if err := p.installHabitat(o, comm); err != nil {
+		if err := platform.InstallHabitat(o, comm); err != nil {
+			return err
+		}
+	}
+
+	// A pinned version is checked during validation, but 'latest' (or an empty version, which installs the latest
+	// release) can only be checked against the target
+	if p.Version == "latest" || p.Version == "" {
+		if err := p.checkRemoteCapabilities(o, comm, platform); err != nil {
 			return err
 		}
 	}
 
 	if p.RingKeyContent != "" {
 		o.Output("Uploading supervisor ring key...")
-		if err := p.uploadRingKey(o, comm); err != nil {
+		if err := platform.UploadRingKey(o, comm); err != nil {
 			return err
 		}
 	}
 
 	if p.CtlSecret != "" {
 		o.Output("Uploading ctl secret...")
-		if err := p.uploadCtlSecret(o, comm); err != nil {
+		if err := platform.UploadCtlSecret(o, comm); err != nil {
 			return err
 		}
 	}
 
 	o.Output("Starting the habitat supervisor...")
-	if err := p.startHabitat(o, comm); err != nil {
+	if err := platform.StartHabitat(o, comm); err != nil {
+		return err
+	}
+
+	parallelism := p.Parallelism
+	if parallelism > 1 && !platform.ConcurrentSessions() {
+		o.Output(fmt.Sprintf("Parallel execution is not supported on %s targets, continuing sequentially...", platform.Name()))
+		parallelism = 1
+	}
+
+	// Each service gets its own output prefix when running concurrently, so interleaved lines remain readable
+	serviceOutput := func(service Service) terraform.UIOutput { return o }
+	if parallelism > 1 {
+		shared := newSyncOutput(o)
+		serviceOutput = func(service Service) terraform.UIOutput {
+			return newPrefixedOutput(shared, fmt.Sprintf("[%s] ", service.Name))
+		}
+	}
+
+	// Load services in dependency order, so producers are running before the services bound to them
+	services, err := sortServices(p.Services)
+	if err != nil {
+		return err
+	}
+
+	deps, err := serviceDependencies(services)
+	if err != nil {
+		return err
+	}
+
+	// Package installs don't depend on each other, so they all run up front
+	err = runServices(services, nil, parallelism, func(service Service) error {
+		so := serviceOutput(service)
+		so.Output("Installing package: " + service.Name)
+		return platform.InstallHabitatPackage(so, comm, service)
+	})
+	if err != nil {
 		return err
 	}
 
-	if p.Services != nil {
-		for _, service := range p.Services {
-			o.Output("Starting service: " + service.Name)
-			if err := p.startHabitatService(o, comm, service); err != nil {
+	return runServices(services, deps, parallelism, func(service Service) error {
+		so := serviceOutput(service)
+		so.Output("Starting service: " + service.Name)
+		if err := platform.StartHabitatService(so, comm, service); err != nil {
+			return err
+		}
+
+		if service.WaitForHealth && !service.Unload {
+			so.Output("Waiting for service to become healthy: " + service.Name)
+			if err := platform.WaitForServiceHealth(so, comm, service); err != nil {
 				return err
 			}
 		}
+
+		return nil
+	})
+}
+
+// checkRemoteCapabilities verifies the installed Habitat release supports every setting in use
+func (p *provisioner) checkRemoteCapabilities(o terraform.UIOutput, comm communicator.Communicator, platform Platform) error {
+	installed := platform.HabitatVersion(o, comm)
+	if installed == "" {
+		o.Output("Unable to detect the installed Habitat version, skipping compatibility checks...")
+		return nil
 	}
 
-	return nil
+	errs := checkCapabilities(installed, func(setting string) bool {
+		return p.settings[setting]
+	})
+	if len(errs) == 0 {
+		return nil
+	}
+
+	msgs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Errorf("the installed Habitat release is incompatible with this configuration:\n  %s", strings.Join(msgs, "\n  "))
 }
 
 func validateFn(c *terraform.ResourceConfig) (ws []string, es []error) {
@@ -429,6 +827,29 @@ func validateFn(c *terraform.ResourceConfig) (ws []string, es []error) {
 		}
 	}
 
+	// The Windows service account needs a user to apply the password to
+	servicePassword, ok := c.Get("windows_service_password")
+	if ok && servicePassword != "" && servicePassword != hcl2shim.UnknownVariableValue {
+		serviceUser, userOk := c.Get("windows_service_user")
+		if !userOk || serviceUser == "" {
+			es = append(es, errors.New("if windows_service_password is specified, windows_service_user must be specified as well"))
+		}
+	}
+
+	// Validate privilege escalation
+	if become, ok := c.Get("become"); ok {
+		es = append(es, validateBecome(become)...)
+	}
+
+	// Validate settings against a pinned Habitat version
+	habVersion, ok := c.Get("version")
+	if v, isString := habVersion.(string); ok && isString && v != "" && v != "latest" && v != hcl2shim.UnknownVariableValue {
+		es = append(es, checkCapabilities(v, func(setting string) bool {
+			value, ok := c.Get(setting)
+			return ok && isSetConfigValue(value)
+		})...)
+	}
+
 	// Validate service level opts
 	services, ok := c.Get("service")
 	if ok {
@@ -438,6 +859,28 @@ func validateFn(c *terraform.ResourceConfig) (ws []string, es []error) {
 		}
 	}
 
+	// Validate service dependencies
+	if _, err := sortServices(getServicesFromConfig(services)); err != nil {
+		es = append(es, err)
+	}
+
+	// Validate health checks, which rely on the HTTP gateway
+	httpDisable, ok := c.Get("http_disable")
+	if ok && httpDisable == true {
+		for _, service := range getServicesFromConfig(services) {
+			if service.WaitForHealth {
+				es = append(es, fmt.Errorf("service %q: wait_for_health requires the HTTP gateway, which is disabled by http_disable", service.Name))
+			}
+		}
+	}
+
+	// The service password is only passed to 'hab svc load' on Windows, where services run as a Windows account
+	for _, service := range getServicesFromConfig(services) {
+		if service.SvcUserPassword != "" {
+			ws = append(ws, fmt.Sprintf("service %q: svc_user_password only applies to Windows targets, and is ignored on Linux", service.Name))
+		}
+	}
+
 	// Validate event stream opts
 	eventStream, ok := c.Get("event_stream")
 	if ok {
@@ -465,12 +908,53 @@ type Service struct {
 	ServiceGroupKey string
 	Reload          bool
 	Unload          bool
+	DependsOn       []string
+	WaitForHealth   bool
+	HealthTimeout   int
+	SvcUserPassword string
 }
 
 func (s *Service) getPackageName(fullName string) string {
 	return strings.Split(fullName, "/")[1]
 }
 
+// localAddress returns the address a listener is reached at from the target itself, mapping wildcard binds to the
+// loopback address, or an empty string when the listener is unset or unparsable
+func localAddress(listen string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return ""
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// getGatewayURL returns the base URL of the supervisor's HTTP gateway, as reached from the target itself
+func (p *provisioner) getGatewayURL() string {
+	address := "127.0.0.1:9631"
+	if a := localAddress(p.ListenHTTP); a != "" {
+		address = a
+	}
+
+	return "http://" + address
+}
+
+// getRemoteSupOption returns the '--remote-sup' option pointing hab's ctl commands at a custom listen_ctl, or an empty
+// string when the supervisor listens on the default ctl gateway
+func (p *provisioner) getRemoteSupOption() string {
+	if a := localAddress(p.ListenCtl); a != "" {
+		return " --remote-sup " + a
+	}
+	return ""
+}
+
+// getHealthURL returns the HTTP gateway endpoint reporting the health of a service
+func (p *provisioner) getHealthURL(s Service) string {
+	return fmt.Sprintf("%s/services/%s/%s/health", p.getGatewayURL(), s.getPackageName(s.Name), s.serviceGroup())
+}
+
 func (s *Service) getServiceNameChecksum() string {
 	return fmt.Sprintf("%x", sha256.Sum256([]byte(s.Name)))
 }
@@ -510,6 +994,62 @@ func decodeConfig(d *schema.ResourceData) (*provisioner, error) {
 		BuilderAuthToken: d.Get("builder_auth_token").(string),
 		GatewayAuthToken: d.Get("gateway_auth_token").(string),
 		EventStream:      getEventStream(d.Get("event_stream").(*schema.Set).List()),
+
+		KeepLatestPackages:           d.Get("keep_latest_packages").(int),
+		SysIPAddress:                 d.Get("sys_ip_address").(string),
+		LocalGossipMode:              d.Get("local_gossip_mode").(bool),
+		PeerWatchFile:                d.Get("peer_watch_file").(string),
+		CacheKeyPath:                 d.Get("cache_key_path").(string),
+		UpdateCondition:              d.Get("update_condition").(string),
+		ServiceMinBackoffPeriod:      d.Get("service_min_backoff_period").(int),
+		ServiceMaxBackoffPeriod:      d.Get("service_max_backoff_period").(int),
+		ServiceRestartCooldownPeriod: d.Get("service_restart_cooldown_period").(int),
+		Parallelism:                  d.Get("parallelism").(int),
+		HabUser:                      d.Get("hab_user").(string),
+		HabGroup:                     d.Get("hab_group").(string),
+		UID:                          d.Get("uid").(int),
+		GID:                          d.Get("gid").(int),
+		Shell:                        d.Get("shell").(string),
+		StagingDir:                   d.Get("staging_dir").(string),
+		Proxy:                        getProxy(d.Get("proxy").([]interface{})),
+		CABundleContent:              d.Get("ca_bundle_content").(string),
+		Retry:                        getRetry(d.Get("retry").([]interface{})),
+		ManageFirewall:               d.Get("manage_firewall").(bool),
+		Teardown:                     d.Get("teardown").(bool),
+		WindowsServiceDebug:          d.Get("windows_service_debug").(bool),
+		WindowsServiceLogLevel:       d.Get("windows_service_log_level").(string),
+		WindowsServiceUser:           d.Get("windows_service_user").(string),
+		WindowsServicePassword:       d.Get("windows_service_password").(string),
+		Systemd:                      getSystemd(d.Get("systemd").([]interface{})),
+		ReadinessTimeout:             d.Get("readiness_timeout").(int),
+		DiagnosticsOnFailure:         d.Get("diagnostics_on_failure").(bool),
+		DiagnosticsDir:               d.Get("diagnostics_dir").(string),
+		DryRun:                       d.Get("dry_run").(bool),
+		Become:                       getBecome(d.Get("become").([]interface{}), d.Get("use_sudo").(bool)),
+		settings:                     make(map[string]bool),
+	}
+
+	for _, c := range capabilities {
+		_, p.settings[c.Setting] = d.GetOk(c.Setting)
+	}
+
+	p.addSecret(p.BuilderAuthToken)
+	p.addSecret(p.GatewayAuthToken)
+	p.addSecret(p.CtlSecret)
+	p.addSecret(p.RingKeyContent)
+	// The Windows ring key import passes the key with its newlines escaped for PowerShell
+	p.addSecret(strings.ReplaceAll(p.RingKeyContent, "\n", "`n"))
+	p.addSecret(p.WindowsServicePassword)
+	p.addSecret(p.Become.Password)
+	for _, password := range p.Proxy.passwords() {
+		p.addSecret(password)
+	}
+	if p.EventStream != nil {
+		p.addSecret(p.EventStream.Token)
+	}
+	for _, service := range p.Services {
+		p.addSecret(service.SvcUserPassword)
+		p.addSecret(service.ServiceGroupKey)
 	}
 
 	return p, nil
@@ -539,6 +1079,10 @@ func getServices(v []interface{}) []Service {
 		serviceGroupKey := serviceData["service_key"].(string)
 		reload := serviceData["reload"].(bool)
 		unload := serviceData["unload"].(bool)
+		dependsOn := getPeers(serviceData["depends_on"].([]interface{}))
+		waitForHealth := serviceData["wait_for_health"].(bool)
+		healthTimeout := serviceData["health_timeout"].(int)
+		svcUserPassword := serviceData["svc_user_password"].(string)
 		var bindStrings []string
 		binds := getBinds(serviceData["bind"].(*schema.Set).List())
 		for _, b := range serviceData["binds"].([]interface{}) {
@@ -564,12 +1108,103 @@ func getServices(v []interface{}) []Service {
 			ServiceGroupKey: serviceGroupKey,
 			Reload:          reload,
 			Unload:          unload,
+			DependsOn:       dependsOn,
+			WaitForHealth:   waitForHealth,
+			HealthTimeout:   healthTimeout,
+			SvcUserPassword: svcUserPassword,
 		}
 		services = append(services, service)
 	}
 	return services
 }
 
+// getServicesFromConfig decodes the parts of the raw 'service' blocks needed during validation, skipping any values
+// which are not yet known.
+func getServicesFromConfig(v interface{}) []Service {
+	rawServices, ok := v.([]interface{})
+	if !ok {
+		return nil
+	}
+
+	var services []Service
+	for _, rawServiceData := range rawServices {
+		serviceData, ok := rawServiceData.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		name, ok := serviceData["name"].(string)
+		if !ok || name == hcl2shim.UnknownVariableValue || !strings.Contains(name, "/") {
+			continue
+		}
+
+		service := Service{Name: name}
+		service.Group, _ = serviceData["group"].(string)
+		service.WaitForHealth, _ = serviceData["wait_for_health"].(bool)
+		service.SvcUserPassword, _ = serviceData["svc_user_password"].(string)
+		service.DependsOn = getKnownStrings(serviceData["depends_on"])
+		for _, b := range getKnownStrings(serviceData["binds"]) {
+			if bind, err := getBindFromString(b); err == nil {
+				service.Binds = append(service.Binds, bind)
+			}
+		}
+		if rawBinds, ok := serviceData["bind"].([]interface{}); ok {
+			for _, rawBindData := range rawBinds {
+				bindData, ok := rawBindData.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				alias, _ := bindData["alias"].(string)
+				svc, _ := bindData["service"].(string)
+				group, _ := bindData["group"].(string)
+				service.Binds = append(service.Binds, Bind{Alias: alias, Service: svc, Group: group})
+			}
+		}
+
+		services = append(services, service)
+	}
+
+	return services
+}
+
+// isSetConfigValue reports whether a raw config value is known and not the zero value of its type
+func isSetConfigValue(v interface{}) bool {
+	switch value := v.(type) {
+	case nil:
+		return false
+	case string:
+		return value != "" && value != hcl2shim.UnknownVariableValue
+	case bool:
+		return value
+	case int:
+		return value != 0
+	case float64:
+		return value != 0
+	case []interface{}:
+		return len(value) > 0
+	case []map[string]interface{}:
+		return len(value) > 0
+	case map[string]interface{}:
+		return len(value) > 0
+	}
+	return true
+}
+
+func getKnownStrings(v interface{}) []string {
+	raw, ok := v.([]interface{})
+	if !ok {
+		return nil
+	}
+
+	var values []string
+	for _, r := range raw {
+		if s, ok := r.(string); ok && s != hcl2shim.UnknownVariableValue {
+			values = append(values, s)
+		}
+	}
+	return values
+}
+
 func getBinds(v []interface{}) []Bind {
 	binds := make([]Bind, 0, len(v))
 	for _, rawBindData := range v {
@@ -590,11 +1225,43 @@ func getBinds(v []interface{}) []Bind {
 func (p *provisioner) copyOutput(o terraform.UIOutput, r io.Reader) {
 	lr := linereader.New(r)
 	for line := range lr.Ch {
-		o.Output(line)
+		o.Output(p.redact(line))
+	}
+}
+
+// addSecret registers a value to mask, in both its raw form and as quoted within a PowerShell string
+func (p *provisioner) addSecret(secret string) {
+	if secret == "" {
+		return
+	}
+	p.secrets = append(p.secrets, secret)
+	if quoted := windowsQuote(secret); quoted != secret {
+		p.secrets = append(p.secrets, quoted)
 	}
 }
 
+// redact masks every registered secret in a command, error message or line of output
+func (p *provisioner) redact(s string) string {
+	for _, secret := range p.secrets {
+		s = strings.ReplaceAll(s, secret, "********")
+	}
+	return s
+}
+
+// redactError masks secrets in the command reported by a failed command, keeping its exit status for retries
+func (p *provisioner) redactError(err error) error {
+	if exitErr, ok := err.(*remote.ExitError); ok {
+		return &remote.ExitError{Command: p.redact(exitErr.Command), ExitStatus: exitErr.ExitStatus, Err: exitErr.Err}
+	}
+	return err
+}
+
 func (p *provisioner) runCommand(o terraform.UIOutput, comm communicator.Communicator, command string) error {
+	return p.runCommandCapture(o, comm, command, nil)
+}
+
+// runCommandCapture runs a command like runCommand, additionally copying its stdout and stderr to capture if given
+func (p *provisioner) runCommandCapture(o terraform.UIOutput, comm communicator.Communicator, command string, capture io.Writer) error {
 	outR, outW := io.Pipe()
 	errR, errW := io.Pipe()
 
@@ -603,23 +1270,77 @@ func (p *provisioner) runCommand(o terraform.UIOutput, comm communicator.Communi
 	defer outW.Close()
 	defer errW.Close()
 
+	var stdout, stderr io.Writer = outW, errW
+	if capture != nil {
+		stdout = io.MultiWriter(outW, capture)
+		stderr = io.MultiWriter(errW, capture)
+	}
+
 	cmd := &remote.Cmd{
 		Command: command,
-		Stdout:  outW,
-		Stderr:  errW,
+		Stdin:   p.Become.stdin(),
+		Stdout:  stdout,
+		Stderr:  stderr,
 	}
 
 	if err := comm.Start(cmd); err != nil {
-		return fmt.Errorf("error executing command %q: %v", cmd.Command, err)
+		return fmt.Errorf("error executing command %q: %v", p.redact(cmd.Command), err)
 	}
 
 	if err := cmd.Wait(); err != nil {
-		return err
+		return p.redactError(err)
 	}
 
 	return nil
 }
 
+// runCommandOutput runs a command like runCommand, but captures its stdout and returns it instead of displaying it
+func (p *provisioner) runCommandOutput(o terraform.UIOutput, comm communicator.Communicator, command string) (string, error) {
+	var stdout bytes.Buffer
+	errR, errW := io.Pipe()
+
+	go p.copyOutput(o, errR)
+	defer errW.Close()
+
+	cmd := &remote.Cmd{
+		Command: command,
+		Stdin:   p.Become.stdin(),
+		Stdout:  &stdout,
+		Stderr:  errW,
+	}
+
+	if err := comm.Start(cmd); err != nil {
+		return "", fmt.Errorf("error executing command %q: %v", p.redact(cmd.Command), err)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return "", p.redactError(err)
+	}
+
+	return stdout.String(), nil
+}
+
+// parseHabVersion extracts the release from 'hab --version' output (eg 'hab 1.6.181/20201030172917')
+func parseHabVersion(output string) string {
+	fields := strings.Fields(output)
+	if len(fields) < 2 || fields[0] != "hab" {
+		return ""
+	}
+	return fields[1]
+}
+
+// versionMatches reports whether an installed release (eg '1.6.181/20201030172917') satisfies the configured
+// version, which may omit the release timestamp.  'latest' is satisfied by any installed release.
+func versionMatches(installed, version string) bool {
+	if installed == "" {
+		return false
+	}
+	if version == "" || version == "latest" {
+		return true
+	}
+	return installed == version || strings.HasPrefix(installed, version+"/")
+}
+
 func getBindFromString(bind string) (Bind, error) {
 	t := strings.FieldsFunc(bind, func(d rune) bool {
 		switch d {
@@ -646,40 +1367,44 @@ type EventStream struct {
 }
 
 func (es *EventStream) FlagValues() string {
-	var flags string
+	return es.args().linux()
+}
+
+func (es *EventStream) args() habArgs {
+	var args habArgs
 
 	if es.Application != "" {
-		flags += fmt.Sprintf(" --event-stream-application %s", es.Application)
+		args.addValue("event-stream-application", es.Application)
 	}
 
 	if es.Environment != "" {
-		flags += fmt.Sprintf(" --event-stream-environment %s", es.Environment)
+		args.addValue("event-stream-environment", es.Environment)
 	}
 
-	flags += fmt.Sprintf(" --event-stream-connect-timeout %v", es.ConnectTimeout)
+	args.addValue("event-stream-connect-timeout", strconv.Itoa(es.ConnectTimeout))
 
 	metaTags := es.getSortedMetaTags()
 	if len(metaTags) > 0 {
-		flags += fmt.Sprintf(" --event-meta %q", strings.Join(metaTags, " "))
+		args.addValue("event-meta", strings.Join(metaTags, " "))
 	}
 
 	if es.ServerCertificate != "" {
-		flags += fmt.Sprintf(" --event-stream-server-certificate %s", es.ServerCertificate)
+		args.addValue("event-stream-server-certificate", es.ServerCertificate)
 	}
 
 	if es.Site != "" {
-		flags += fmt.Sprintf(" --event-stream-site %s", es.Site)
+		args.addValue("event-stream-site", es.Site)
 	}
 
 	if es.Token != "" {
-		flags += fmt.Sprintf(" --event-stream-token %s", es.Token)
+		args.addValue("event-stream-token", es.Token)
 	}
 
 	if es.Url != "" {
-		flags += fmt.Sprintf(" --event-stream-url %s", es.Url)
+		args.addValue("event-stream-url", es.Url)
 	}
 
-	return flags
+	return args
 }
 
 // Pulled this out to it's own method so we can sort the meta tag by keys for more consistent testing
@@ -1,8 +1,12 @@
 package habitat
 
 import (
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/hashicorp/terraform/communicator"
+	"github.com/hashicorp/terraform/communicator/remote"
 	"github.com/hashicorp/terraform/helper/schema"
 	"github.com/hashicorp/terraform/terraform"
 )
@@ -85,6 +89,199 @@ func TestResourceProvisioner_Validate_bad_service_definition(t *testing.T) {
 	}
 }
 
+func TestResourceProvisioner_Validate_service_dependency_cycle(t *testing.T) {
+	c := testConfig(t, map[string]interface{}{
+		"service": []interface{}{
+			map[string]interface{}{
+				"name":       "core/foo",
+				"depends_on": []interface{}{"core/bar"},
+			},
+			map[string]interface{}{
+				"name":  "core/bar",
+				"binds": []interface{}{"backend:foo.default"},
+			},
+		},
+	})
+
+	warn, errs := Provision().Validate(c)
+	if len(warn) > 0 {
+		t.Fatalf("Warnings: %v", warn)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("Should have one error, got %d", len(errs))
+	}
+}
+
+func TestResourceProvisioner_Validate_health_without_http(t *testing.T) {
+	c := testConfig(t, map[string]interface{}{
+		"http_disable": true,
+		"service": []interface{}{
+			map[string]interface{}{
+				"name":            "core/foo",
+				"wait_for_health": true,
+			},
+		},
+	})
+
+	warn, errs := Provision().Validate(c)
+	if len(warn) > 0 {
+		t.Fatalf("Warnings: %v", warn)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("Should have one error, got %d", len(errs))
+	}
+}
+
+func TestResourceProvisioner_Validate_unsupported_version(t *testing.T) {
+	c := testConfig(t, map[string]interface{}{
+		"version":      "0.79.1",
+		"license":      "accept",
+		"http_disable": true,
+	})
+
+	warn, errs := Provision().Validate(c)
+	if len(warn) > 0 {
+		t.Fatalf("Warnings: %v", warn)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("Should have one error, got %d", len(errs))
+	}
+}
+
+func TestResourceProvisioner_Validate_empty_version(t *testing.T) {
+	c := testConfig(t, map[string]interface{}{
+		"version": "",
+		"license": "accept",
+	})
+
+	warn, errs := Provision().Validate(c)
+	if len(warn) > 0 {
+		t.Fatalf("Warnings: %v", warn)
+	}
+	if len(errs) > 0 {
+		t.Fatalf("Errors: %v", errs)
+	}
+}
+
+func TestResourceProvisioner_Validate_duplicate_service(t *testing.T) {
+	c := testConfig(t, map[string]interface{}{
+		"service": []interface{}{
+			map[string]interface{}{"name": "core/foo", "group": "blue"},
+			map[string]interface{}{"name": "core/foo", "group": "green"},
+		},
+	})
+
+	warn, errs := Provision().Validate(c)
+	if len(warn) > 0 {
+		t.Fatalf("Warnings: %v", warn)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("Should have one error, got %d: %v", len(errs), errs)
+	}
+}
+
+func TestResourceProvisioner_Validate_svc_user_password(t *testing.T) {
+	c := testConfig(t, map[string]interface{}{
+		"service": []interface{}{
+			map[string]interface{}{
+				"name":              "core/foo",
+				"svc_user_password": "s3cret",
+			},
+		},
+	})
+
+	warn, errs := Provision().Validate(c)
+	if len(errs) > 0 {
+		t.Fatalf("Errors: %v", errs)
+	}
+	if len(warn) != 1 {
+		t.Fatalf("Should have one warning, got %d: %v", len(warn), warn)
+	}
+}
+
+func TestResourceProvisioner_Validate_become(t *testing.T) {
+	c := testConfig(t, map[string]interface{}{
+		"become": []interface{}{
+			map[string]interface{}{
+				"method":       "su",
+				"password":     "s3cret",
+				"preserve_env": []interface{}{"http_proxy"},
+			},
+		},
+	})
+
+	warn, errs := Provision().Validate(c)
+	if len(warn) > 0 {
+		t.Fatalf("Warnings: %v", warn)
+	}
+	if len(errs) != 2 {
+		t.Fatalf("Should have two errors, got %d: %v", len(errs), errs)
+	}
+}
+
+func TestResourceProvisioner_Validate_windowsServicePassword(t *testing.T) {
+	c := testConfig(t, map[string]interface{}{
+		"windows_service_password": "s3cret",
+	})
+
+	warn, errs := Provision().Validate(c)
+	if len(warn) > 0 {
+		t.Fatalf("Warnings: %v", warn)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("Should have one error, got %d: %v", len(errs), errs)
+	}
+}
+
+func TestProvisioner_redact(t *testing.T) {
+	p, err := decodeConfig(
+		schema.TestResourceDataRaw(t, Provision().(*schema.Provisioner).Schema, map[string]interface{}{
+			"windows_service_user":     "svc-habitat",
+			"windows_service_password": "p@ss'word",
+			"service": []interface{}{
+				map[string]interface{}{
+					"name":              "core/foo",
+					"svc_user_password": "s3cret",
+				},
+			},
+		}),
+	)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	c := new(communicator.MockCommunicator)
+	c.CommandFunc = func(cmd *remote.Cmd) error {
+		_, _ = cmd.Stdout.Write([]byte("logging on with s3cret\n"))
+		cmd.SetExitStatus(1, nil)
+		return nil
+	}
+
+	o := &recordingOutput{}
+	err = p.runCommand(o, c, "hab svc load core/foo --password 's3cret'; sc.exe config Habitat password= 'p@ss''word'")
+	if err == nil {
+		t.Fatal("expected the command to fail")
+	}
+	if _, ok := err.(*remote.ExitError); !ok {
+		t.Fatalf("expected an exit error, got %T", err)
+	}
+	if strings.Contains(err.Error(), "s3cret") || strings.Contains(err.Error(), "p@ss") {
+		t.Fatalf("expected secrets to be redacted, got %v", err)
+	}
+
+	// Output is copied asynchronously, so give it a moment to arrive
+	redacted := false
+	for i := 0; i < 100 && !redacted; i++ {
+		o.Lock()
+		redacted = o.contains("logging on with ********")
+		o.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !redacted {
+		t.Fatal("expected output to be redacted")
+	}
+}
+
 func testConfig(t *testing.T, c map[string]interface{}) *terraform.ResourceConfig {
 	return terraform.NewResourceConfigRaw(c)
 }
@@ -0,0 +1,137 @@
+package habitat
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/terraform/communicator"
+	"github.com/hashicorp/terraform/communicator/remote"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+// Retry describes how network bound commands (installer downloads, package installs and service loads) are retried
+// when they fail, eg during a Builder outage
+type Retry struct {
+	Attempts       int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// ExitCodes and OutputPatterns restrict retries to matching failures.  When both are empty, any failure is retried.
+	ExitCodes      []int
+	OutputPatterns []*regexp.Regexp
+}
+
+// retrySleep waits between attempts, and is replaced in tests
+var retrySleep = time.Sleep
+
+// getRetry decodes the 'retry' block.  Without one, every command runs exactly once.
+func getRetry(v []interface{}) Retry {
+	r := Retry{Attempts: 1}
+	for _, rawRetryData := range v {
+		retryData, ok := rawRetryData.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		r.Attempts = retryData["attempts"].(int)
+		r.InitialBackoff = time.Duration(retryData["initial_backoff"].(int)) * time.Second
+		r.MaxBackoff = time.Duration(retryData["max_backoff"].(int)) * time.Second
+		for _, code := range retryData["exit_codes"].([]interface{}) {
+			r.ExitCodes = append(r.ExitCodes, code.(int))
+		}
+		for _, pattern := range retryData["output_patterns"].([]interface{}) {
+			// Patterns are checked by the schema, so an invalid one can't reach this point
+			if re, err := regexp.Compile(pattern.(string)); err == nil {
+				r.OutputPatterns = append(r.OutputPatterns, re)
+			}
+		}
+	}
+	return r
+}
+
+// retryable reports whether a failed attempt, given its error and combined output, should be tried again
+func (r Retry) retryable(err error, output string) bool {
+	if len(r.ExitCodes) == 0 && len(r.OutputPatterns) == 0 {
+		return true
+	}
+
+	if exitErr, ok := err.(*remote.ExitError); ok && exitErr.Err == nil {
+		for _, code := range r.ExitCodes {
+			if exitErr.ExitStatus == code {
+				return true
+			}
+		}
+	}
+
+	for _, re := range r.OutputPatterns {
+		if re.MatchString(output) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// backoff returns the delay before the given retry (starting at 1), doubling from the initial backoff up to the max
+func (r Retry) backoff(retry int) time.Duration {
+	delay := r.InitialBackoff
+	for i := 1; i < retry && delay < r.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if r.MaxBackoff > 0 && delay > r.MaxBackoff {
+		delay = r.MaxBackoff
+	}
+	return delay
+}
+
+// runNetworkCommand runs a command which talks to Builder or downloads the installer, retrying it according to the
+// 'retry' block.  Every failed attempt is logged before the next one starts.
+func (p *provisioner) runNetworkCommand(o terraform.UIOutput, comm communicator.Communicator, command string) error {
+	for attempt := 1; ; attempt++ {
+		var output lockedBuffer
+		err := p.runCommandCapture(o, comm, command, &output)
+		if err == nil {
+			return nil
+		}
+
+		if attempt >= p.Retry.Attempts || !p.Retry.retryable(err, output.String()) {
+			return err
+		}
+
+		delay := p.Retry.backoff(attempt)
+		o.Output(fmt.Sprintf("Attempt %d of %d failed (%s), retrying in %s...", attempt, p.Retry.Attempts, describeCommandError(err), delay))
+		retrySleep(delay)
+	}
+}
+
+// describeCommandError summarises a command failure without repeating the command itself
+func describeCommandError(err error) string {
+	if exitErr, ok := err.(*remote.ExitError); ok {
+		if exitErr.Err != nil {
+			return exitErr.Err.Error()
+		}
+		return fmt.Sprintf("exit status %d", exitErr.ExitStatus)
+	}
+	return err.Error()
+}
+
+// lockedBuffer collects a command's stdout and stderr, which the communicator may write concurrently
+type lockedBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,134 @@
+package habitat
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/terraform/communicator"
+	"github.com/hashicorp/terraform/communicator/remote"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+func TestRunNetworkCommand(t *testing.T) {
+	cases := map[string]struct {
+		Retry    map[string]interface{}
+		Failures []int
+		Output   string
+		Attempts int
+		Error    bool
+		Delays   []time.Duration
+	}{
+		"No retry block runs once": {
+			Failures: []int{1},
+			Attempts: 1,
+			Error:    true,
+		},
+		"Succeeds after transient failures": {
+			Retry: map[string]interface{}{
+				"attempts":        4,
+				"initial_backoff": 2,
+				"max_backoff":     3,
+			},
+			Failures: []int{1, 1},
+			Attempts: 3,
+			Delays:   []time.Duration{2 * time.Second, 3 * time.Second},
+		},
+		"Gives up after the last attempt": {
+			Retry: map[string]interface{}{
+				"attempts": 2,
+			},
+			Failures: []int{1, 1, 1},
+			Attempts: 2,
+			Error:    true,
+			Delays:   []time.Duration{5 * time.Second},
+		},
+		"Unlisted exit code is not retried": {
+			Retry: map[string]interface{}{
+				"exit_codes": []interface{}{7},
+			},
+			Failures: []int{1},
+			Attempts: 1,
+			Error:    true,
+		},
+		"Listed exit code is retried": {
+			Retry: map[string]interface{}{
+				"exit_codes": []interface{}{7},
+			},
+			Failures: []int{7},
+			Attempts: 2,
+			Delays:   []time.Duration{5 * time.Second},
+		},
+		"Matching output is retried": {
+			Retry: map[string]interface{}{
+				"exit_codes":      []interface{}{7},
+				"output_patterns": []interface{}{"(?i)connection reset"},
+			},
+			Failures: []int{1},
+			Output:   "Error: Connection reset by peer",
+			Attempts: 2,
+			Delays:   []time.Duration{5 * time.Second},
+		},
+	}
+
+	defer func(sleep func(time.Duration)) { retrySleep = sleep }(retrySleep)
+
+	for k, tc := range cases {
+		config := map[string]interface{}{}
+		if tc.Retry != nil {
+			config["retry"] = []interface{}{tc.Retry}
+		}
+
+		p, err := decodeConfig(
+			schema.TestResourceDataRaw(t, Provision().(*schema.Provisioner).Schema, config),
+		)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+
+		var delays []time.Duration
+		retrySleep = func(d time.Duration) { delays = append(delays, d) }
+
+		attempts := 0
+		c := new(communicator.MockCommunicator)
+		c.CommandFunc = func(cmd *remote.Cmd) error {
+			attempts++
+			if attempts > len(tc.Failures) {
+				cmd.SetExitStatus(0, nil)
+				return nil
+			}
+			_, _ = cmd.Stdout.Write([]byte(tc.Output))
+			cmd.SetExitStatus(tc.Failures[attempts-1], nil)
+			return nil
+		}
+
+		o := &recordingOutput{}
+		err = p.runNetworkCommand(o, c, "hab pkg install core/foo")
+		if tc.Error != (err != nil) {
+			t.Fatalf("Test %q: unexpected error result: %v", k, err)
+		}
+		if attempts != tc.Attempts {
+			t.Fatalf("Test %q: expected %d attempts, got %d", k, tc.Attempts, attempts)
+		}
+		if len(delays) != len(tc.Delays) {
+			t.Fatalf("Test %q: expected delays %v, got %v", k, tc.Delays, delays)
+		}
+		for i := range delays {
+			if delays[i] != tc.Delays[i] {
+				t.Fatalf("Test %q: expected delays %v, got %v", k, tc.Delays, delays)
+			}
+		}
+
+		retries := 0
+		o.Lock()
+		for _, line := range o.lines {
+			if strings.HasPrefix(line, "Attempt ") {
+				retries++
+			}
+		}
+		o.Unlock()
+		if retries != len(tc.Delays) {
+			t.Fatalf("Test %q: expected every retry to be logged, got %v", k, o.lines)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package habitat
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// serviceGroup returns the service group the service joins, matching the supervisor's own default.
+func (s *Service) serviceGroup() string {
+	if s.Group != "" {
+		return s.Group
+	}
+	return "default"
+}
+
+// isReferencedBy reports whether a 'depends_on' entry refers to this service.  Entries may be the full package
+// identifier used in 'name', the 'origin/name' prefix of it, or the bare package name.
+func (s *Service) isReferencedBy(ref string) bool {
+	if ref == s.Name || strings.HasPrefix(s.Name, ref+"/") {
+		return true
+	}
+	return !strings.Contains(ref, "/") && ref == s.getPackageName(s.Name)
+}
+
+// isBoundBy reports whether a bind targets this service, when it runs on the same supervisor.
+func (s *Service) isBoundBy(b Bind) bool {
+	return b.Service == s.getPackageName(s.Name) && b.Group == s.serviceGroup()
+}
+
+// serviceDependencies returns, for each service name, the names of the local services it must be loaded after.
+// Edges come from explicit 'depends_on' entries, and are inferred from binds targeting another configured service.
+func serviceDependencies(services []Service) (map[string][]string, error) {
+	deps := make(map[string][]string, len(services))
+
+	// Services are keyed by name, and a supervisor only runs one service per package anyway
+	for i, service := range services {
+		for _, other := range services[:i] {
+			if other.Name == service.Name {
+				return nil, fmt.Errorf("service %q is configured more than once", service.Name)
+			}
+		}
+	}
+
+	for _, consumer := range services {
+		seen := map[string]bool{}
+		add := func(name string) {
+			if name != consumer.Name && !seen[name] {
+				seen[name] = true
+				deps[consumer.Name] = append(deps[consumer.Name], name)
+			}
+		}
+
+		for _, ref := range consumer.DependsOn {
+			found := false
+			for _, producer := range services {
+				if producer.isReferencedBy(ref) {
+					add(producer.Name)
+					found = true
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("service %q depends on %q, which is not a configured service", consumer.Name, ref)
+			}
+		}
+
+		for _, bind := range consumer.Binds {
+			for _, producer := range services {
+				if producer.isBoundBy(bind) {
+					add(producer.Name)
+				}
+			}
+		}
+
+		sort.Strings(deps[consumer.Name])
+	}
+
+	return deps, nil
+}
+
+// sortServices orders services so every producer is loaded before its consumers.  Services without a dependency
+// between them are ordered by name, so the result does not depend on the order of the 'service' set.
+func sortServices(services []Service) ([]Service, error) {
+	deps, err := serviceDependencies(services)
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]Service, len(services))
+	names := make([]string, 0, len(services))
+	for _, s := range services {
+		byName[s.Name] = s
+		names = append(names, s.Name)
+	}
+	sort.Strings(names)
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(services))
+	sorted := make([]Service, 0, len(services))
+
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("service dependency cycle detected: %s", strings.Join(append(path, name), " -> "))
+		}
+
+		state[name] = visiting
+		for _, dep := range deps[name] {
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		sorted = append(sorted, byName[name])
+
+		return nil
+	}
+
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return sorted, nil
+}
+
+// runServices calls fn for every service, keeping at most parallelism calls in flight.  A service is only started
+// once each of its dependencies completed successfully; with a parallelism of 1 services run in the given order.
+// After the first error no further services are started, and that error is returned once in-flight calls finish.
+func runServices(services []Service, deps map[string][]string, parallelism int, fn func(Service) error) error {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	type result struct {
+		name string
+		err  error
+	}
+
+	results := make(chan result)
+	started := make(map[string]bool, len(services))
+	done := make(map[string]bool, len(services))
+	running := 0
+	var firstErr error
+
+	ready := func(s Service) bool {
+		for _, dep := range deps[s.Name] {
+			if !done[dep] {
+				return false
+			}
+		}
+		return true
+	}
+
+	for {
+		if firstErr == nil {
+			for _, s := range services {
+				if running >= parallelism {
+					break
+				}
+				if started[s.Name] || !ready(s) {
+					continue
+				}
+
+				started[s.Name] = true
+				running++
+				go func(s Service) {
+					results <- result{name: s.Name, err: fn(s)}
+				}(s)
+			}
+		}
+
+		if running == 0 {
+			return firstErr
+		}
+
+		r := <-results
+		running--
+		if r.err != nil && firstErr == nil {
+			firstErr = r.err
+		}
+		done[r.name] = r.err == nil
+	}
+}
@@ -0,0 +1,167 @@
+package habitat
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSortServices(t *testing.T) {
+	cases := map[string]struct {
+		Services []Service
+		Order    []string
+		Error    string
+	}{
+		"Independent services are ordered by name": {
+			Services: []Service{
+				{Name: "core/redis"},
+				{Name: "core/nginx"},
+			},
+			Order: []string{"core/nginx", "core/redis"},
+		},
+		"Explicit depends_on": {
+			Services: []Service{
+				{Name: "core/app", DependsOn: []string{"core/zookeeper"}},
+				{Name: "core/zookeeper/3.4.14"},
+			},
+			Order: []string{"core/zookeeper/3.4.14", "core/app"},
+		},
+		"depends_on by package name": {
+			Services: []Service{
+				{Name: "core/app", DependsOn: []string{"zookeeper"}},
+				{Name: "core/zookeeper"},
+			},
+			Order: []string{"core/zookeeper", "core/app"},
+		},
+		"Inferred from local binds": {
+			Services: []Service{
+				{Name: "core/app", Binds: []Bind{{Alias: "database", Service: "postgresql", Group: "prod"}}},
+				{Name: "core/postgresql", Group: "prod"},
+				{Name: "core/haproxy", Binds: []Bind{{Alias: "backend", Service: "app", Group: "default"}}},
+			},
+			Order: []string{"core/postgresql", "core/app", "core/haproxy"},
+		},
+		"Binds to remote service groups add no edges": {
+			Services: []Service{
+				{Name: "core/app", Binds: []Bind{{Alias: "database", Service: "postgresql", Group: "other"}}},
+				{Name: "core/postgresql"},
+			},
+			Order: []string{"core/app", "core/postgresql"},
+		},
+		"Unknown dependency": {
+			Services: []Service{
+				{Name: "core/app", DependsOn: []string{"core/missing"}},
+			},
+			Error: `service "core/app" depends on "core/missing", which is not a configured service`,
+		},
+		"Duplicate service": {
+			Services: []Service{
+				{Name: "core/app", Group: "blue"},
+				{Name: "core/app", Group: "green"},
+			},
+			Error: `service "core/app" is configured more than once`,
+		},
+		"Dependency cycle": {
+			Services: []Service{
+				{Name: "core/a", DependsOn: []string{"core/b"}},
+				{Name: "core/b", Binds: []Bind{{Alias: "a", Service: "a", Group: "default"}}},
+			},
+			Error: "service dependency cycle detected: core/a -> core/b -> core/a",
+		},
+	}
+
+	for k, tc := range cases {
+		sorted, err := sortServices(tc.Services)
+		if tc.Error != "" {
+			if err == nil || err.Error() != tc.Error {
+				t.Fatalf("Test %q: expected error %q, got %v", k, tc.Error, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %q failed: %v", k, err)
+		}
+
+		var order []string
+		for _, s := range sorted {
+			order = append(order, s.Name)
+		}
+		if strings.Join(order, ",") != strings.Join(tc.Order, ",") {
+			t.Fatalf("Test %q: expected order %v, got %v", k, tc.Order, order)
+		}
+	}
+}
+
+func TestRunServices(t *testing.T) {
+	services := []Service{
+		{Name: "core/a"},
+		{Name: "core/b"},
+		{Name: "core/c", DependsOn: []string{"core/a", "core/b"}},
+		{Name: "core/d"},
+	}
+	deps, err := serviceDependencies(services)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	var mu sync.Mutex
+	finished := map[string]bool{}
+	running, maxRunning := 0, 0
+
+	err = runServices(services, deps, 2, func(s Service) error {
+		mu.Lock()
+		for _, dep := range deps[s.Name] {
+			if !finished[dep] {
+				t.Errorf("%s started before its dependency %s finished", s.Name, dep)
+			}
+		}
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		finished[s.Name] = true
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	if len(finished) != len(services) {
+		t.Fatalf("expected %d services to run, got %d", len(services), len(finished))
+	}
+	if maxRunning != 2 {
+		t.Fatalf("expected 2 services to run concurrently, got %d", maxRunning)
+	}
+}
+
+func TestRunServices_error(t *testing.T) {
+	services := []Service{
+		{Name: "core/a"},
+		{Name: "core/b", DependsOn: []string{"core/a"}},
+	}
+	deps, err := serviceDependencies(services)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	var ran []string
+	err = runServices(services, deps, 4, func(s Service) error {
+		ran = append(ran, s.Name)
+		return errors.New("failed to load " + s.Name)
+	})
+	if err == nil || err.Error() != "failed to load core/a" {
+		t.Fatalf("expected the core/a failure, got %v", err)
+	}
+	if strings.Join(ran, ",") != "core/a" {
+		t.Fatalf("dependent services should not run after a failure, ran %v", ran)
+	}
+}
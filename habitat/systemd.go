@@ -0,0 +1,50 @@
+package habitat
+
+import (
+	"sort"
+)
+
+// systemdDropInName is the file name the 'drop_in_content' is uploaded as, within the unit's drop-in directory
+const systemdDropInName = "terraform-provisioner.conf"
+
+// systemdDirective is a single 'Key=value' line of a systemd unit
+type systemdDirective struct {
+	Name  string
+	Value string
+}
+
+// Systemd customizes the supervisor's systemd unit.  Directives are sorted by name, so the rendered unit (and its
+// checksum) only changes when the configuration does.
+type Systemd struct {
+	Unit          []systemdDirective
+	Service       []systemdDirective
+	Environment   []envVar
+	DropInContent string
+}
+
+func getSystemd(v []interface{}) Systemd {
+	var s Systemd
+	for _, rawSystemdData := range v {
+		systemdData, ok := rawSystemdData.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		s.Unit = getSystemdDirectives(systemdData["unit"].(map[string]interface{}))
+		s.Service = getSystemdDirectives(systemdData["service"].(map[string]interface{}))
+		for _, d := range getSystemdDirectives(systemdData["environment"].(map[string]interface{})) {
+			s.Environment = append(s.Environment, envVar(d))
+		}
+		s.DropInContent = systemdData["drop_in_content"].(string)
+	}
+	return s
+}
+
+func getSystemdDirectives(v map[string]interface{}) []systemdDirective {
+	directives := make([]systemdDirective, 0, len(v))
+	for name, value := range v {
+		directives = append(directives, systemdDirective{Name: name, Value: value.(string)})
+	}
+	sort.Slice(directives, func(i, j int) bool { return directives[i].Name < directives[j].Name })
+	return directives
+}
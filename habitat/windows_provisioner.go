@@ -36,140 +36,188 @@ func (p *provisioner) windowsInstallHabitat(o terraform.UIOutput, comm communica
 	}
 
 	// Download habitat
-	err = p.runCommand(o, comm, p.windowsGetCommand(`irm https://raw.githubusercontent.com/habitat-sh/habitat/master/components/hab/install.ps1 > C:\Windows\TEMP\install.ps1`))
+	err = p.runNetworkCommand(o, comm, p.windowsGetCommand(`irm https://raw.githubusercontent.com/habitat-sh/habitat/master/components/hab/install.ps1 > C:\Windows\TEMP\install.ps1`))
 	if err != nil {
 		return err
 	}
 
-	// Install habitat
-	err = p.runCommand(o, comm, p.windowsRunFileWithArgs("C:\\Windows\\TEMP\\install.ps1", fmt.Sprintf("-Version %s", p.Version)))
+	// Install habitat.  install.ps1 downloads hab itself, so behind a proxy it runs within a command which set it up.
+	install := p.windowsRunFileWithArgs("C:\\Windows\\TEMP\\install.ps1", fmt.Sprintf("-Version %s", p.Version))
+	if p.Proxy.enabled() {
+		install = p.windowsGetCommand(fmt.Sprintf("& C:\\Windows\\TEMP\\install.ps1 -Version %s", p.Version))
+	}
+	err = p.runNetworkCommand(o, comm, install)
 	if err != nil {
 		return err
 	}
 
 	// Install version dependent hab-sup
 	if p.Version != "latest" {
-		err = p.runCommand(o, comm, p.windowsGetCommand(fmt.Sprintf(`hab pkg install core/hab-sup/%s`, p.Version)))
+		err = p.runNetworkCommand(o, comm, p.windowsGetCommand(fmt.Sprintf(`hab pkg install core/hab-sup/%s`, p.Version)))
 		if err != nil {
 			return err
 		}
 	} else {
-		err = p.runCommand(o, comm, p.windowsGetCommand(`hab pkg install core/hab-sup`))
+		err = p.runNetworkCommand(o, comm, p.windowsGetCommand(`hab pkg install core/hab-sup`))
 		if err != nil {
 			return err
 		}
 	}
 
 	// Install habitat service pkg (which automatically invokes the install hook for setting up the Windows service)
-	err = p.runCommand(o, comm, p.windowsGetCommand(`hab pkg install core/windows-service`))
+	err = p.runNetworkCommand(o, comm, p.windowsGetCommand(`hab pkg install core/windows-service`))
 	if err != nil {
 		return err
 	}
 
-	// Setup Windows firewall
-	err = p.runCommand(o, comm, p.windowsGetCommand(`New-NetFirewallRule -DisplayName \"Habitat TCP\" -Direction Inbound -Action Allow -Protocol TCP -LocalPort 9631,9638`))
+	return nil
+}
+
+// This returns the installed hab CLI release, or an empty string when hab is missing
+func (p *provisioner) windowsHabitatVersion(o terraform.UIOutput, comm communicator.Communicator) string {
+	output, err := p.runCommandOutput(o, comm, p.windowsGetCommand("hab --version"))
 	if err != nil {
-		return err
+		return ""
 	}
+	return parseHabVersion(output)
+}
 
-	err = p.runCommand(o, comm, p.windowsGetCommand(`New-NetFirewallRule -DisplayName \"Habitat UDP\" -Direction Inbound -Action Allow -Protocol UDP -LocalPort 9638`))
-	if err != nil {
+func (p *provisioner) windowsStartHabitat(o terraform.UIOutput, comm communicator.Communicator) error {
+	// Open the supervisor's ports before it (re)starts with them
+	if err := p.windowsConfigureFirewall(o, comm); err != nil {
 		return err
 	}
 
-	// Set ctl gateway secret token
-	if p.GatewayAuthToken != "" {
-		err = p.runCommand(o, comm, p.windowsGetCommand(fmt.Sprintf(`[System.Environment]::SetEnvironmentVariable(\"HAB_SUP_GATEWAY_AUTH_TOKEN\", \"%s\", [System.EnvironmentVariableTarget]::Machine)`, p.GatewayAuthToken)))
-		if err != nil {
-			return err
-		}
-
-		err = p.runCommand(o, comm, p.windowsGetCommand(fmt.Sprintf(`[System.Environment]::SetEnvironmentVariable(\"HAB_SUP_GATEWAY_AUTH_TOKEN\", \"%s\", [System.EnvironmentVariableTarget]::Process)`, p.GatewayAuthToken)))
-		if err != nil {
-			return err
-		}
+	options := p.supervisorArgs().windows()
+	p.SupOptions = options
 
-		err = p.runCommand(o, comm, p.windowsGetCommand(fmt.Sprintf(`[System.Environment]::SetEnvironmentVariable(\"HAB_SUP_GATEWAY_AUTH_TOKEN\", \"%s\", [System.EnvironmentVariableTarget]::User)`, p.GatewayAuthToken)))
-		if err != nil {
-			return err
-		}
+	settings := []windowsServiceSetting{
+		{Key: "launcherArgs", Value: options},
+		{Key: "debug", Value: fmt.Sprintf("%t", p.WindowsServiceDebug)},
 	}
 
-	return nil
+	notePlan(comm, "The Habitat service is only restarted if its config, environment or account changed, or started if it isn't running")
+	return p.runCommand(o, comm, p.windowsGetCommand(p.windowsServiceConfigScript(settings)))
 }
 
-func (p *provisioner) windowsStartHabitat(o terraform.UIOutput, comm communicator.Communicator) error {
-	var err error
-	var content string
-	var options string
+// windowsServiceSetting is an appSettings entry in the windows-service package's HabService.dll.config
+type windowsServiceSetting struct {
+	Key   string
+	Value string
+}
 
-	if p.PermanentPeer {
-		options += " --permanent-peer"
-	}
+// windowsServiceConfigScript updates HabService.dll.config, looking each appSettings entry up by key (and adding it if
+// missing) rather than relying on the package's element order, and sets the service's environment and the account it
+// runs as.  The service is only restarted when one of them changed, or started if it isn't running.
+func (p *provisioner) windowsServiceConfigScript(settings []windowsServiceSetting) string {
+	var content string
 
-	if p.ListenGossip != "" {
-		options += fmt.Sprintf(" --listen-gossip %s", p.ListenGossip)
-	}
+	content += "$svcPath = Join-Path $env:SystemDrive \"hab\\svc\\windows-service\";"
+	content += "$configPath = Join-Path $svcPath HabService.dll.config;"
+	content += "[xml]$configXml = Get-Content $configPath;"
+	content += "$changed = $false;"
 
-	if p.ListenHTTP != "" {
-		options += fmt.Sprintf(" --listen-http %s", p.ListenHTTP)
+	for _, setting := range settings {
+		key, value := windowsQuote(setting.Key), windowsQuote(setting.Value)
+		content += fmt.Sprintf("$node = $configXml.SelectSingleNode('/configuration/appSettings/add[@key=''%s'']');", key)
+		content += fmt.Sprintf("if (-not $node) { $node = $configXml.CreateElement('add'); $node.SetAttribute('key', '%s'); [void]$configXml.SelectSingleNode('/configuration/appSettings').AppendChild($node) };", key)
+		content += fmt.Sprintf("$value = '%s';", value)
+		content += "if ($node.GetAttribute('value') -ne $value) { $node.SetAttribute('value', $value); $changed = $true };"
 	}
 
-	if len(p.Peers) > 0 {
-		if len(p.Peers) == 1 {
-			options += fmt.Sprintf(" --peer %s", p.Peers[0])
-		} else {
-			options += fmt.Sprintf(" --peer %s", strings.Join(p.Peers, " --peer "))
-		}
+	// Without a configured level, whatever the package (or an administrator) set is left alone
+	if p.WindowsServiceLogLevel != "" {
+		content += "$node = $configXml.SelectSingleNode('/configuration/log4net/root/level');"
+		content += fmt.Sprintf("$value = '%s';", p.WindowsServiceLogLevel)
+		content += "if ($node -and $node.GetAttribute('value') -ne $value) { $node.SetAttribute('value', $value); $changed = $true };"
 	}
 
-	if p.RingKey != "" {
-		options += fmt.Sprintf(" --ring %s", p.RingKey)
+	// The service's own environment is read by the service control manager on every start, unlike the machine
+	// environment, which services only see after a reboot
+	var env []string
+	for _, v := range p.SupervisorEnvironment() {
+		env = append(env, fmt.Sprintf("'%s=%s'", windowsQuote(v.Name), windowsQuote(v.Value)))
 	}
 
-	if p.URL != "" {
-		options += fmt.Sprintf(" --url %s", p.URL)
+	content += "$serviceKey = 'HKLM:\\SYSTEM\\CurrentControlSet\\Services\\Habitat';"
+	content += "$current = (Get-ItemProperty -Path $serviceKey -Name Environment -ErrorAction SilentlyContinue).Environment;"
+	if len(env) > 0 {
+		content += fmt.Sprintf("$environment = @(%s);", strings.Join(env, ","))
+		content += "if ((@($current) -join [char]10) -ne ($environment -join [char]10)) { New-ItemProperty -Path $serviceKey -Name Environment -PropertyType MultiString -Value $environment -Force | out-null; $changed = $true };"
+	} else {
+		content += "if ($current) { Remove-ItemProperty -Path $serviceKey -Name Environment; $changed = $true };"
 	}
 
-	if p.Channel != "" {
-		options += fmt.Sprintf(" --channel %s", p.Channel)
-	}
+	// The password can't be compared, so it is re-applied on every run and takes effect on the next (re)start.  The
+	// service control manager reports local accounts as '.\user', and an unqualified user matches any domain, so the
+	// account is compared by name unless the configured user names its domain.
+	if p.WindowsServiceUser != "" {
+		user := windowsQuote(p.WindowsServiceUser)
+		account := fmt.Sprintf("obj= '%s'", user)
+		if p.WindowsServicePassword != "" {
+			account += fmt.Sprintf(" password= '%s'", windowsQuote(p.WindowsServicePassword))
+		}
 
-	if p.Events != "" {
-		options += fmt.Sprintf(" --events %s", p.Events)
+		content += "$service = Get-CimInstance Win32_Service -Filter 'Name=''Habitat''';"
+		content += fmt.Sprintf("$account = '%s';", user)
+		content += "if ($account.StartsWith('.\\')) { $account = $account.Substring(2) };"
+		content += "$startName = [string]$service.StartName;"
+		content += "if (-not $account.Contains('\\')) { $startName = $startName.Split('\\')[-1] };"
+		content += "if ($startName -ne $account) { $changed = $true };"
+		content += fmt.Sprintf("sc.exe config Habitat %s | out-null;", account)
+		content += "if ($LASTEXITCODE -ne 0) { exit $LASTEXITCODE };"
 	}
 
-	if p.Organization != "" {
-		options += fmt.Sprintf(" --org %s", p.Organization)
-	}
+	content += "if ($changed) { $configXml.Save($configPath); Restart-Service Habitat } elseif ((Get-Service Habitat).Status -ne 'Running') { Start-Service Habitat }"
 
-	if p.HttpDisable {
-		options += " --http-disable"
-	}
+	return content
+}
 
-	if p.AutoUpdate {
-		options += " --auto-update"
+// This creates or updates an inbound rule for every exposed supervisor port.  Rules have stable names, so re-runs
+// update them in place, and rules for listeners which are no longer exposed (including the fixed 'Habitat TCP' and
+// 'Habitat UDP' rules of earlier releases) are removed.
+func (p *provisioner) windowsConfigureFirewall(o terraform.UIOutput, comm communicator.Communicator) error {
+	exposed := map[string]bool{}
+	for _, port := range p.firewallPorts() {
+		exposed[port.Name] = true
+		name := windowsFirewallRuleName(port.Name)
+		protocol := strings.ToUpper(port.Protocol)
+
+		command := fmt.Sprintf("if (Get-NetFirewallRule -Name '%s' -ErrorAction SilentlyContinue) { Set-NetFirewallRule -Name '%s' -Protocol %s -LocalPort %d } else { New-NetFirewallRule -Name '%s' -DisplayName 'Habitat Supervisor %s' -Direction Inbound -Action Allow -Protocol %s -LocalPort %d | out-null }",
+			name, name, protocol, port.Port, name, port.Name, protocol, port.Port)
+		if err := p.runCommand(o, comm, p.windowsGetCommand(command)); err != nil {
+			return err
+		}
 	}
 
-	if p.EventStream != nil {
-		options += p.EventStream.FlagValues()
+	var stale []string
+	for _, name := range firewallPortNames {
+		if !exposed[name] {
+			stale = append(stale, name)
+		}
 	}
 
-	options += " --no-color"
-
-	p.SupOptions = options
+	return p.windowsRemoveFirewallRules(o, comm, stale)
+}
 
-	content += "$svcPath = Join-Path $env:SystemDrive \"hab\\svc\\windows-service\";"
-	content += "[xml]$configXml = Get-Content (Join-Path $svcPath HabService.dll.config);"
-	content += fmt.Sprintf("$configXml.configuration.appSettings.ChildNodes[\"2\"].value = '%s';", options)
-	content += "$configXml.Save((Join-Path $svcPath HabService.dll.config));"
+// windowsRemoveFirewall removes every rule created by windowsConfigureFirewall
+func (p *provisioner) windowsRemoveFirewall(o terraform.UIOutput, comm communicator.Communicator) error {
+	return p.windowsRemoveFirewallRules(o, comm, firewallPortNames)
+}
 
-	err = p.runCommand(o, comm, p.windowsGetCommand(content))
-	if err != nil {
-		return err
+// windowsRemoveFirewallRules removes the rules for the given listeners, along with the fixed rules of earlier releases
+func (p *provisioner) windowsRemoveFirewallRules(o terraform.UIOutput, comm communicator.Communicator, names []string) error {
+	var rules []string
+	for _, name := range names {
+		rules = append(rules, fmt.Sprintf("'%s'", windowsFirewallRuleName(name)))
 	}
 
-	return p.runCommand(o, comm, p.windowsGetCommand("Restart-Service Habitat"))
+	command := fmt.Sprintf("Get-NetFirewallRule | Where-Object { @(%s) -contains $_.Name -or @('Habitat TCP','Habitat UDP') -contains $_.DisplayName } | Remove-NetFirewallRule", strings.Join(rules, ","))
+	return p.runCommand(o, comm, p.windowsGetCommand(command))
+}
+
+func windowsFirewallRuleName(name string) string {
+	return "Habitat-" + name
 }
 
 func (p *provisioner) windowsUploadRingKey(o terraform.UIOutput, comm communicator.Communicator) error {
@@ -177,23 +225,39 @@ func (p *provisioner) windowsUploadRingKey(o terraform.UIOutput, comm communicat
 	return p.runCommand(o, comm, fmt.Sprintf(`powershell.exe -Command echo %s | hab ring key import`, p.RingKeyContent))
 }
 
-func (p *provisioner) windowsUploadCtlSecret(o terraform.UIOutput, comm communicator.Communicator) error {
-	destination := "C:\\hab\\sup\\default"
-	err := p.runCommand(o, comm, p.windowsGetCommand(fmt.Sprintf("mkdir %s | out-null", destination)))
-	if err != nil {
+// This uploads the custom CA bundle into the hab ssl cache, where hab adds it to the certificates it trusts, and
+// imports each of its certificates into the machine's trusted roots, which PowerShell's irm of the installer relies on.
+// Import-Certificate only reads the first certificate of a file, so the bundle is split first.
+func (p *provisioner) windowsUploadCABundle(o terraform.UIOutput, comm communicator.Communicator) error {
+	destination := "C:\\hab\\cache\\ssl"
+	if err := p.windowsCreateDirectory(o, comm, destination); err != nil {
+		return err
+	}
+
+	bundle := fmt.Sprintf("%s\\%s", destination, caBundleName)
+	if err := comm.Upload(bundle, strings.NewReader(p.CABundleContent)); err != nil {
 		return err
 	}
 
-	return comm.Upload(fmt.Sprintf("%s\\CTL_SECRET", destination), strings.NewReader(p.CtlSecret))
+	command := fmt.Sprintf("foreach ($cert in [regex]::Matches((Get-Content -Raw '%s'), '(?s)-----BEGIN CERTIFICATE-----.+?-----END CERTIFICATE-----')) { $file = [IO.Path]::GetTempFileName(); Set-Content -Path $file -Value $cert.Value; Import-Certificate -FilePath $file -CertStoreLocation Cert:\\LocalMachine\\Root | out-null; Remove-Item $file }", bundle)
+	return p.runCommand(o, comm, p.windowsGetCommand(command))
 }
 
-func (p *provisioner) windowsStartHabitatService(o terraform.UIOutput, comm communicator.Communicator, service Service) error {
-	var options string
+func (p *provisioner) windowsUploadCtlSecret(o terraform.UIOutput, comm communicator.Communicator) error {
+	destination := "C:\\hab\\sup\\default"
+	if err := p.windowsCreateDirectory(o, comm, destination); err != nil {
+		return err
+	}
 
-	if err := p.windowsInstallHabitatPackage(o, comm, service); err != nil {
+	secret := fmt.Sprintf("%s\\CTL_SECRET", destination)
+	if err := comm.Upload(secret, strings.NewReader(p.CtlSecret)); err != nil {
 		return err
 	}
 
+	return p.windowsRestrictAccess(o, comm, secret)
+}
+
+func (p *provisioner) windowsStartHabitatService(o terraform.UIOutput, comm communicator.Communicator, service Service) error {
 	if strings.TrimSpace(service.UserTOML) != "" {
 		if err := p.windowsUploadUserTOML(o, comm, service); err != nil {
 			return err
@@ -206,28 +270,10 @@ func (p *provisioner) windowsStartHabitatService(o terraform.UIOutput, comm comm
 		}
 	}
 
-	if service.Topology != "" {
-		options += fmt.Sprintf(" --topology %s", service.Topology)
-	}
-
-	if service.Strategy != "" {
-		options += fmt.Sprintf(" --strategy %s", service.Strategy)
-	}
-
-	if service.Channel != "" {
-		options += fmt.Sprintf(" --channel %s", service.Channel)
-	}
-
-	if service.URL != "" {
-		options += fmt.Sprintf(" --url %s", service.URL)
-	}
-
-	if service.Group != "" {
-		options += fmt.Sprintf(" --group %s", service.Group)
-	}
-
-	for _, bind := range service.Binds {
-		options += fmt.Sprintf(" --bind %s", bind.toBindString())
+	options := service.loadArgs().windows()
+	if service.SvcUserPassword != "" {
+		// Only Windows supervisors accept the password of the user a service runs as
+		options += fmt.Sprintf(" --password '%s'", windowsQuote(service.SvcUserPassword))
 	}
 
 	// If the svc is already loaded and we require re-loading, unload the service before continuing (don't care
@@ -240,7 +286,7 @@ func (p *provisioner) windowsStartHabitatService(o terraform.UIOutput, comm comm
 	// If the requested service is already loaded, skip re-loading it
 	if !service.Unload {
 		if err := p.windowsHabitatServiceLoaded(o, comm, service); err != nil {
-			return p.runCommand(o, comm, p.windowsGetCommand(fmt.Sprintf("hab svc load %s %s", service.Name, options)))
+			return p.runNetworkCommand(o, comm, p.windowsGetCommand(fmt.Sprintf("hab svc load%s %s %s", p.getRemoteSupOption(), service.Name, options)))
 		}
 	}
 
@@ -249,25 +295,51 @@ func (p *provisioner) windowsStartHabitatService(o terraform.UIOutput, comm comm
 
 // This is a check to see if a habitat svc is already loaded on the machine
 func (p *provisioner) windowsHabitatServiceUnload(o terraform.UIOutput, comm communicator.Communicator, service Service) error {
-	return p.runCommand(o, comm, p.windowsGetCommand(fmt.Sprintf("hab svc unload %s 2>&1 | out-null ; start-sleep -s 3", service.Name)))
+	return p.runCommand(o, comm, p.windowsGetCommand(fmt.Sprintf("hab svc unload%s %s 2>&1 | out-null ; start-sleep -s 3", p.getRemoteSupOption(), service.Name)))
 }
 
 func (p *provisioner) windowsHabitatServiceLoaded(o terraform.UIOutput, comm communicator.Communicator, service Service) error {
-	return p.runCommand(o, comm, p.windowsGetCommand(fmt.Sprintf("hab svc status %s 2>&1 | out-null", service.Name)))
+	return p.runCommand(o, comm, p.windowsGetCommand(fmt.Sprintf("hab svc status%s %s 2>&1 | out-null", p.getRemoteSupOption(), service.Name)))
 }
 
-func (p *provisioner) windowsInstallHabitatPackage(o terraform.UIOutput, comm communicator.Communicator, service Service) error {
-	var options string
+// This polls the HTTP gateway until the service reports a healthy status, or the service's health timeout expires
+func (p *provisioner) windowsWaitForServiceHealth(o terraform.UIOutput, comm communicator.Communicator, service Service) error {
+	attempts := (service.HealthTimeout + 4) / 5
+	command := fmt.Sprintf("$i = 0; while ($i -lt %d) { try { Invoke-WebRequest -UseBasicParsing%s -Uri %s | out-null; exit 0 } catch { start-sleep -s 5 }; $i++ }; echo 'Timed out waiting for %s to become healthy'; exit 1", attempts, p.windowsGatewayAuthHeader(), p.getHealthURL(service), service.Name)
+	return p.runCommand(o, comm, p.windowsGetCommand(command))
+}
+
+// This returns the Invoke-WebRequest option authenticating with the HTTP gateway, which rejects other requests once
+// gateway_auth_token is set
+func (p *provisioner) windowsGatewayAuthHeader() string {
+	if p.GatewayAuthToken == "" {
+		return ""
+	}
+	return fmt.Sprintf(" -Headers @{Authorization='Bearer %s'}", windowsQuote(p.GatewayAuthToken))
+}
 
-	if service.Channel != "" {
-		options += fmt.Sprintf(" --channel %s", service.Channel)
+// windowsDiagnostics lists what is gathered into the support bundle, from the windows-service log and config to the
+// services the supervisor has loaded
+func (p *provisioner) windowsDiagnostics() []diagnostic {
+	diagnostics := []diagnostic{
+		{"hab --version", "hab --version 2>&1"},
+		{"hab svc status", fmt.Sprintf("hab svc status%s 2>&1", p.getRemoteSupOption())},
+		{"census", fmt.Sprintf("(Invoke-WebRequest -UseBasicParsing%s -Uri %s/census).Content", p.windowsGatewayAuthHeader(), p.getGatewayURL())},
+		{"service specs", "Get-ChildItem (Join-Path $env:SystemDrive 'hab\\sup\\default\\specs\\*.spec') | ForEach-Object { '==> ' + $_.FullName; Get-Content $_.FullName }"},
+		{"supervisor log", "Get-Content (Join-Path $env:SystemDrive 'hab\\svc\\windows-service\\logs\\Habitat.log') -Tail 200"},
+		{"supervisor service config", "Get-Content (Join-Path $env:SystemDrive 'hab\\svc\\windows-service\\HabService.dll.config')"},
 	}
 
-	if service.URL != "" {
-		options += fmt.Sprintf(" --url %s", service.URL)
+	for i, d := range diagnostics {
+		diagnostics[i].Command = p.windowsGetCommand(d.Command)
 	}
+	return diagnostics
+}
+
+func (p *provisioner) windowsInstallHabitatPackage(o terraform.UIOutput, comm communicator.Communicator, service Service) error {
+	options := service.installArgs().windows()
 
-	return p.runCommand(o, comm, p.windowsGetCommand(fmt.Sprintf("hab pkg install %s %s", service.Name, options)))
+	return p.runNetworkCommand(o, comm, p.windowsGetCommand(fmt.Sprintf("hab pkg install %s %s", service.Name, options)))
 }
 
 func (p *provisioner) windowsUploadServiceGroupKey(o terraform.UIOutput, comm communicator.Communicator, service Service) error {
@@ -275,8 +347,18 @@ func (p *provisioner) windowsUploadServiceGroupKey(o terraform.UIOutput, comm co
 	o.Output("Uploading service group key: " + keyName)
 	keyFileName := fmt.Sprintf("%s.box.key", keyName)
 	keyContent := strings.NewReader(service.ServiceGroupKey)
+	destDir := "C:\\hab\\cache\\keys"
+
+	if err := p.windowsCreateDirectory(o, comm, destDir); err != nil {
+		return err
+	}
 
-	return comm.Upload(fmt.Sprintf("C:\\hab\\cache\\keys\\%s", keyFileName), keyContent)
+	destPath := fmt.Sprintf("%s\\%s", destDir, keyFileName)
+	if err := comm.Upload(destPath, keyContent); err != nil {
+		return err
+	}
+
+	return p.windowsRestrictAccess(o, comm, destPath)
 }
 
 func (p *provisioner) windowsUploadUserTOML(o terraform.UIOutput, comm communicator.Communicator, service Service) error {
@@ -284,9 +366,7 @@ func (p *provisioner) windowsUploadUserTOML(o terraform.UIOutput, comm communica
 	o.Output("Uploading user.toml for service: " + service.Name)
 	svcName := service.getPackageName(service.Name)
 	destDir := fmt.Sprintf("C:\\hab\\user\\%s\\config", svcName)
-	command := fmt.Sprintf("mkdir %s | out-null", destDir)
-
-	if err := p.runCommand(o, comm, p.windowsGetCommand(command)); err != nil {
+	if err := p.windowsCreateDirectory(o, comm, destDir); err != nil {
 		return err
 	}
 
@@ -295,6 +375,17 @@ func (p *provisioner) windowsUploadUserTOML(o terraform.UIOutput, comm communica
 	return comm.Upload(fmt.Sprintf("%s\\user.toml", destDir), userToml)
 }
 
+// This creates a directory along with any missing parents, succeeding when it already exists
+func (p *provisioner) windowsCreateDirectory(o terraform.UIOutput, comm communicator.Communicator, dir string) error {
+	return p.runCommand(o, comm, p.windowsGetCommand(fmt.Sprintf("New-Item -ItemType Directory -Force -Path %s | out-null", dir)))
+}
+
+// This limits access to a secret to SYSTEM and the Administrators group, replacing any inherited ACLs.  Well known SIDs
+// are used so the grants don't depend on the system's display language.
+func (p *provisioner) windowsRestrictAccess(o terraform.UIOutput, comm communicator.Communicator, file string) error {
+	return p.runCommand(o, comm, p.windowsGetCommand(fmt.Sprintf("icacls %s /inheritance:r /grant:r '*S-1-5-18:(F)' '*S-1-5-32-544:(F)' | out-null", file)))
+}
+
 func (p *provisioner) windowsGetCommand(command string) string {
 	// Always set HAB_NONINTERACTIVE & HAB_NOCOLORING
 	env := `$Env:HAB_NONINTERACTIVE=\"true\"; $Env:HAB_NOCOLORING=\"true\"; `
@@ -309,6 +400,17 @@ func (p *provisioner) windowsGetCommand(command string) string {
 		env += fmt.Sprintf(`$Env:HAB_AUTH_TOKEN=\"%s\"; `, p.BuilderAuthToken)
 	}
 
+	// Route the installer and Builder traffic through the proxy.  Windows variables are case insensitive, so only
+	// the upper case spelling is needed.
+	if p.Proxy.enabled() {
+		for _, e := range p.Proxy.Environment() {
+			if e.Name == strings.ToUpper(e.Name) {
+				env += fmt.Sprintf("$Env:%s='%s'; ", e.Name, windowsQuote(e.Value))
+			}
+		}
+		env += p.Proxy.windowsWebProxy()
+	}
+
 	return fmt.Sprintf(`powershell.exe -NoProfile -ExecutionPolicy Bypass -Command "%s%s"`, env, command)
 }
 
@@ -1,12 +1,19 @@
 package main
 
 import (
+	"os"
+
 	"github.com/hashicorp/terraform/plugin"
 	"github.com/hashicorp/terraform/terraform"
 	"github.com/kmott/terraform-provisioner-habitat/habitat"
 )
 
 func main() {
+	// Terraform starts plugins without arguments, so any argument selects the standalone CLI
+	if len(os.Args) > 1 {
+		os.Exit(runCLI(os.Args[1:], os.Stdout, os.Stderr))
+	}
+
 	plugin.Serve(&plugin.ServeOpts{
 		ProvisionerFunc: func() terraform.ResourceProvisioner {
 			return habitat.Provision()